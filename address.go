@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"math/big"
+)
+
+// Version bytes of DragonCoin addresses.  Addresses of single keys start
+// with "D" once encoded, and multisig addresses start with "9" or "A".
+const ADDRESS_VERSION byte = 0x1e
+const MULTISIG_ADDRESS_VERSION byte = 0x16
+
+// An address is a version byte and a key hash, followed by a checksum.
+const ADDRESS_HASH_SIZE int = 20
+const ADDRESS_CHECKSUM_SIZE int = 4
+
+const BASE58_ALPHABET = "123456789ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz"
+
+// Address is a parsed DragonCoin address.
+type Address struct {
+	Version byte
+	Hash    []byte
+}
+
+/**
+ * Hashes an encoded public key, or multisig policy, down to the size
+ * stored in an address.
+ *
+ * @param {String} scheme - The signature scheme of the key.
+ * @param {[]byte} key - The encoded key.
+ *
+ * @returns {[]byte} - The key hash.
+ */
+func keyHash(scheme string, key []byte) []byte {
+	enc := new(txEncoder)
+	enc.writeString(scheme)
+	enc.writeBytes(key)
+	sum := sha256.Sum256(enc.buf.Bytes())
+	return sum[:ADDRESS_HASH_SIZE]
+}
+
+/**
+ * Encodes a version byte and key hash as a Base58Check address.
+ *
+ * @param {Number} version - The version byte.
+ * @param {[]byte} hash - The key hash.
+ *
+ * @returns {String} - The address.
+ */
+func encodeAddress(version byte, hash []byte) string {
+	payload := append([]byte{version}, hash...)
+	return base58Encode(append(payload, addressChecksum(payload)...))
+}
+
+func addressChecksum(payload []byte) []byte {
+	first := sha256.Sum256(payload)
+	second := sha256.Sum256(first[:])
+	return second[:ADDRESS_CHECKSUM_SIZE]
+}
+
+/**
+ * Parses an address, checking its length, checksum and version.
+ *
+ * @param {String} addr - The address.
+ *
+ * @returns {Address} - The parsed address, or an error for a malformed address.
+ */
+func parseAddress(addr string) (Address, error) {
+	raw, err := base58Decode(addr)
+	if err != nil {
+		return Address{}, err
+	}
+	if len(raw) != 1+ADDRESS_HASH_SIZE+ADDRESS_CHECKSUM_SIZE {
+		return Address{}, errors.New("Address has the wrong length")
+	}
+	payload := raw[:1+ADDRESS_HASH_SIZE]
+	if !bytes.Equal(raw[1+ADDRESS_HASH_SIZE:], addressChecksum(payload)) {
+		return Address{}, errors.New("Address checksum does not match")
+	}
+	if payload[0] != ADDRESS_VERSION && payload[0] != MULTISIG_ADDRESS_VERSION {
+		return Address{}, errors.New("Address is for an unknown network or version")
+	}
+	return Address{payload[0], payload[1:]}, nil
+}
+
+/**
+ * Checks that an address is well-formed.
+ *
+ * @param {String} addr - The address.
+ *
+ * @returns {Error} - Why the address is malformed, or nil.
+ */
+func validateAddress(addr string) error {
+	_, err := parseAddress(addr)
+	return err
+}
+
+/**
+ * Checks every recipient of a payment before a transaction is signed.
+ *
+ * @param {Object} outputs - The addresses and amounts to pay.
+ *
+ * @returns {Error} - An error naming the first malformed recipient, or nil.
+ */
+func validateRecipients(outputs map[string]int) error {
+	for addr := range outputs {
+		if err := validateAddress(addr); err != nil {
+			return errors.New("Invalid recipient " + addr + ": " + err.Error())
+		}
+	}
+	return nil
+}
+
+func base58Encode(b []byte) string {
+	n := new(big.Int).SetBytes(b)
+	radix := big.NewInt(int64(len(BASE58_ALPHABET)))
+	mod := new(big.Int)
+	var out []byte
+	for n.Sign() > 0 {
+		n.DivMod(n, radix, mod)
+		out = append(out, BASE58_ALPHABET[mod.Int64()])
+	}
+	// Leading zero bytes are kept as leading "1"s.
+	for _, c := range b {
+		if c != 0 {
+			break
+		}
+		out = append(out, BASE58_ALPHABET[0])
+	}
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
+	}
+	return string(out)
+}
+
+func base58Decode(s string) ([]byte, error) {
+	if s == "" {
+		return nil, errors.New("Address is empty")
+	}
+	n := new(big.Int)
+	radix := big.NewInt(int64(len(BASE58_ALPHABET)))
+	for _, r := range s {
+		i := bytes.IndexRune([]byte(BASE58_ALPHABET), r)
+		if i < 0 {
+			return nil, errors.New("Address contains a character that is not Base58")
+		}
+		n.Mul(n, radix)
+		n.Add(n, big.NewInt(int64(i)))
+	}
+	zeros := 0
+	for zeros < len(s) && s[zeros] == BASE58_ALPHABET[0] {
+		zeros++
+	}
+	return append(make([]byte, zeros), n.Bytes()...), nil
+}
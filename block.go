@@ -2,8 +2,10 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"math/big"
+	"sort"
 )
 
 /**
@@ -16,13 +18,60 @@ type Block struct {
 	PrevBlockHash  string
 	Target         *big.Int
 	Transactions   map[string]Transaction
-	Balances       map[string]int
-	NextNonce      map[string]int
 	ChainLength    int
-	Timestamp      string
+	Timestamp      int64
 	RewardAddr     string
 	CoinbaseReward int
 	Proof          int
+	// Total amount of gold issued up to and including this block's coinbase
+	// reward.  Like TotalWork, it is recomputed by receivers.
+	TotalSupply int
+	// Total work of the chain ending in this block.  It is not part of the
+	// serialized block; receivers recompute it from the targets.
+	TotalWork *big.Int
+	// Settings of the blockchain this block belongs to, inherited from the parent.
+	cfg *BlockChaincfg
+	// Balances and nonces after this block, sharing entries with the parent's ledger.
+	ledger *ledgerState
+}
+
+// BlockHeader is the canonical form of the fields covered by the proof of work.
+// Fields that only apply to one of the genesis/non-genesis shapes are omitted
+// from the other.
+type BlockHeader struct {
+	ChainLength    int
+	Timestamp      int64
+	PrevBlockHash  string `json:",omitempty"`
+	Proof          int    `json:",omitempty"`
+	RewardAddr     string `json:",omitempty"`
+	CoinbaseReward int    `json:",omitempty"`
+	Target         string
+	TxRoot         string         `json:",omitempty"`
+	Balances       []BalanceEntry `json:",omitempty"`
+}
+
+// BalanceEntry is a single address balance, used to give balances a fixed order.
+type BalanceEntry struct {
+	Addr    string
+	Balance int
+}
+
+// blockMessage is the wire form of a block: its header plus the body.
+type blockMessage struct {
+	Header       BlockHeader
+	Transactions []Transaction `json:",omitempty"`
+}
+
+// Returns the balances sorted by address.
+func sortedBalances(balances map[string]int) []BalanceEntry {
+	entries := make([]BalanceEntry, 0, len(balances))
+	for addr, balance := range balances {
+		entries = append(entries, BalanceEntry{addr, balance})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Addr < entries[j].Addr
+	})
+	return entries
 }
 
 /**
@@ -35,29 +84,26 @@ type Block struct {
  * @param {Number} [target] - The POW target.  The miner must find a proof that
  *      produces a smaller value when hashed.
  * @param {Number} [coinbaseReward] - The gold that a miner earns for finding a block proof.
+ * @param {Function} getBlock - Looks up ancestors of the previous block, used for retargeting.
  * blockChain BlockChain, target=Blockchain.powTarget, coinbaseReward=Blockchain.cfg.coinBase, rewardAddr, prevBlock
  */
-func (base Block) makeBlock(rewardAddr string) *Block {
+func (base Block) makeBlock(rewardAddr string, getBlock blockLookup) *Block {
 	block := new(Block)
-	block.Target = base.Target
-	block.CoinbaseReward = base.CoinbaseReward
-	block.Balances = make(map[string]int)
+	block.cfg = base.cfg
+	block.Target = base.nextTarget(getBlock)
 	block.Transactions = make(map[string]Transaction)
-	block.NextNonce = make(map[string]int)
 	block.RewardAddr = rewardAddr
 	block.NotEmpty = true
 
 	block.PrevBlockHash = base.hashVal()
-	for key, value := range base.Balances {
-		block.Balances[key] = value
-	}
-	for key, value := range base.NextNonce {
-		block.NextNonce[key] = value
-	}
+	block.ledger = base.childLedger()
 	block.ChainLength = 1 + base.ChainLength
+	block.accumulateWork(base)
+	block.CoinbaseReward = base.config().coinbaseRewardAt(block.ChainLength, base.TotalSupply)
+	block.TotalSupply = base.TotalSupply + block.CoinbaseReward
 
 	if base.RewardAddr != "" {
-		block.Balances[base.RewardAddr] += base.totalRewards()
+		block.payReward(base)
 	}
 
 	// Adding toJSON methods for transactions and balances, which help with
@@ -69,28 +115,64 @@ func (base Block) makeBlock(rewardAddr string) *Block {
 	//   return JSON.stringify(Array.from(this.balances.entries()));
 	// }
 
-	// Used to determine the winner between competing chains.
-	// Note that this is a little simplistic -- an attacker
-	// could make a long, but low-work chain.  However, this works
-	// well enough for us.
-
-	// this.timestamp = Date.now();
+	// The timestamp is set by the miner, which knows the current time.
 	return block
 }
 
 func (base Block) emptyBlock(blockChain BlockChain) *Block {
 	block := new(Block)
 	//fmt.Println(blockChain)
+	block.cfg = blockChain.cfg
 	block.Target = blockChain.cfg.powTarget
 	block.CoinbaseReward = blockChain.coinbaseAmount
-	block.Balances = make(map[string]int)
 	block.Transactions = make(map[string]Transaction)
-	block.NextNonce = make(map[string]int)
+	block.ledger = newLedgerState()
 	block.ChainLength = 0
 	block.NotEmpty = true
+	block.TotalWork = block.work()
 	return block
 }
 
+/**
+ * Returns the settings of the blockchain this block belongs to.
+ *
+ * @returns {BlockChaincfg} - The blockchain configuration.
+ */
+func (base Block) config() *BlockChaincfg {
+	if base.cfg == nil {
+		return defaultBlockChaincfg
+	}
+	return base.cfg
+}
+
+/**
+ * Returns the median timestamp of this block and its most recent ancestors.
+ * A block following this one may not have an older timestamp.
+ *
+ * @param {Function} getBlock - Looks up ancestors of this block.
+ *
+ * @returns {Number} - The median timestamp in milliseconds.
+ */
+func (base Block) medianTimePast(getBlock blockLookup) int64 {
+	var timestamps []int64
+	block := base
+	for len(timestamps) < MEDIAN_TIME_BLOCKS {
+		timestamps = append(timestamps, block.Timestamp)
+		if block.isGenesisBlock() {
+			break
+		}
+		prevBlock, ok := getBlock(block.PrevBlockHash)
+		if !ok {
+			break
+		}
+		block = prevBlock
+	}
+	sort.Slice(timestamps, func(i, j int) bool {
+		return timestamps[i] < timestamps[j]
+	})
+	return timestamps[len(timestamps)/2]
+}
+
 /**
  * Determines whether the block is the beginning of the chain.
  *
@@ -100,6 +182,63 @@ func (base Block) isGenesisBlock() bool {
 	return base.ChainLength == 0
 }
 
+/**
+ * The expected number of hashes needed to find a proof for this block,
+ * which is 2^256 / (target + 1).
+ *
+ * @returns {big.Int} - The work represented by this block alone.
+ */
+func (base Block) work() *big.Int {
+	if base.Target == nil {
+		return big.NewInt(0)
+	}
+	denominator := new(big.Int).Add(base.Target, big.NewInt(1))
+	numerator := new(big.Int).Lsh(big.NewInt(1), 256)
+	return numerator.Div(numerator, denominator)
+}
+
+/**
+ * Sets the total work of the block to the total work of the previous
+ * block plus the work of this block.
+ *
+ * @param {Block} prevBlock - The previous block in the blockchain.
+ */
+func (base *Block) accumulateWork(prevBlock Block) {
+	base.TotalWork = base.work()
+	if prevBlock.TotalWork != nil {
+		base.TotalWork.Add(base.TotalWork, prevBlock.TotalWork)
+	}
+}
+
+/**
+ * Used to determine the winner between competing chains.  The chain with
+ * the most total work wins; ties are broken by the lower block ID, so that
+ * every node makes the same choice.  A genesis block never competes with
+ * an existing chain, since its target is not backed by any proof of work.
+ *
+ * @param {Block} other - The tip of the competing chain.
+ *
+ * @returns {Boolean} - True if the chain ending in this block should be preferred.
+ */
+func (base Block) hasMoreWorkThan(other Block) bool {
+	if !other.NotEmpty {
+		return true
+	}
+	if base.isGenesisBlock() {
+		return false
+	}
+	if other.TotalWork == nil {
+		return true
+	}
+	if base.TotalWork == nil {
+		return false
+	}
+	if cmp := base.TotalWork.Cmp(other.TotalWork); cmp != 0 {
+		return cmp > 0
+	}
+	return base.getID() < other.getID()
+}
+
 /**
  * Returns true if the hash of the block is less than the target
  * proof of work value.
@@ -107,101 +246,115 @@ func (base Block) isGenesisBlock() bool {
  * @returns {Boolean} - True if the block has a valid proof.
  */
 func (base Block) hasValidProof() bool {
-	h := sha256hash(base.serialize())
-	//fmt.Println(base.serialize())
-	//fmt.Println(h)
 	n := big.NewInt(0)
-	if _, ok := n.SetString(h, 16); ok {
-	} else {
-		fmt.Printf("rip")
+	if _, ok := n.SetString(base.hashVal(), 16); !ok {
+		return false
 	}
-	//fmt.Println(n)
-	//fmt.Println("BLOCK.GO LINE 112")
-	//fmt.Println(n)
-	//fmt.Println(base.target)
 	return n.Cmp(base.Target) < 0
 }
 
 /**
- * Converts a Block into string form.  Some fields are deliberately omitted.
- * Note that Block.deserialize plus block.rerun should restore the block.
+ * Returns the transactions of the block sorted by their IDs.  This is the
+ * canonical order used for hashing and for sending blocks over the wire.
+ *
+ * @returns {Array} - The transactions in canonical order.
+ */
+func (base Block) sortedTransactions() []Transaction {
+	txs := make([]Transaction, 0, len(base.Transactions))
+	for _, tx := range base.Transactions {
+		txs = append(txs, tx)
+	}
+	sort.Slice(txs, func(i, j int) bool {
+		return txs[i].Id < txs[j].Id
+	})
+	return txs
+}
+
+/**
+ * Returns the IDs of the transactions of the block in canonical order.
+ *
+ * @returns {Array} - The sorted transaction IDs.
+ */
+func (base Block) sortedTxIDs() []string {
+	ids := make([]string, 0, len(base.Transactions))
+	for _, tx := range base.sortedTransactions() {
+		ids = append(ids, tx.Id)
+	}
+	return ids
+}
+
+/**
+ * Commits to the transactions of the block, so that the header alone
+ * is enough to identify the block body.
+ *
+ * @returns {String} - The Merkle root of the transaction IDs.
+ */
+func (base Block) txRoot() string {
+	return merkleRoot(base.sortedTxIDs())
+}
+
+/**
+ * Builds the header of the block.  The genesis block does not contain a
+ * proof or transactions, but is the only block that can specify balances.
+ * Other blocks must specify transactions (through their root) and proof details.
+ *
+ * @returns {BlockHeader} - The header of the block.
+ */
+func (base Block) header() BlockHeader {
+	h := BlockHeader{
+		ChainLength: base.ChainLength,
+		Timestamp:   base.Timestamp,
+	}
+	if base.Target != nil {
+		h.Target = base.Target.Text(16)
+	}
+	if base.isGenesisBlock() {
+		h.Balances = sortedBalances(base.ledger.allBalances())
+	} else {
+		h.PrevBlockHash = base.PrevBlockHash
+		h.Proof = base.Proof
+		h.RewardAddr = base.RewardAddr
+		h.CoinbaseReward = base.CoinbaseReward
+		h.TxRoot = base.txRoot()
+	}
+	return h
+}
+
+/**
+ * Converts the header of a Block into its canonical string form.  This is
+ * the part of the block covered by the hash and the proof of work.
+ *
+ * @returns {String} - The block header in JSON format.
+ */
+func (base Block) serializeHeader() string {
+	b, _ := json.Marshal(base.header())
+	return string(b)
+}
+
+/**
+ * Converts a Block into string form.  Balances and nonces are deliberately
+ * omitted (except for the genesis balances, which are part of its header).
+ * Note that deserializeBlock plus block.rerun should restore the block.
  *
  * @returns {String} - The block in JSON format.
  */
 func (base Block) serialize() string {
-	//fmt.Println(base)
-	b, _ := json.Marshal(base)
-	//fmt.Println(string(b))
+	msg := blockMessage{
+		Header:       base.header(),
+		Transactions: base.sortedTransactions(),
+	}
+	b, _ := json.Marshal(msg)
 	return string(b)
-	//return JSON.stringify(this);
-	//if (this.isGenesisBlock()) {
-	//  // The genesis block does not contain a proof or transactions,
-	//  // but is the only block than can specify balances.
-	//  /*******return `
-	//     {"chainLength": "${this.chainLength}",
-	//      "timestamp": "${this.timestamp}",
-	//      "balances": ${JSON.stringify(Array.from(this.balances.entries()))}
-	//     }
-	//  `;****/
-	//  let o = {
-	//    chainLength: this.chainLength,
-	//    timestamp: this.timestamp,
-	//    balances: Array.from(this.balances.entries()),
-	//  };
-	//  return JSON.stringify(o, ['chainLength', 'timestamp', 'balances']);
-	//} else {
-	//  // Other blocks must specify transactions and proof details.
-	//  /******return `
-	//     {"chainLength": "${this.chainLength}",
-	//      "timestamp": "${this.timestamp}",
-	//      "transactions": ${JSON.stringify(Array.from(this.transactions.entries()))},
-	//      "prevBlockHash": "${this.prevBlockHash}",
-	//      "proof": "${this.proof}",
-	//      "rewardAddr": "${this.rewardAddr}"
-	//     }
-	//  `;*****/
-	//  let o = {
-	//    chainLength: this.chainLength,
-	//    timestamp: this.timestamp,
-	//    transactions: Array.from(this.transactions.entries()),
-	//    prevBlockHash: this.prevBlockHash,
-	//    proof: this.proof,
-	//    rewardAddr: this.rewardAddr,
-	//  };
-	//  return JSON.stringify(o, ['chainLength', 'timestamp', 'transactions',
-	//       'prevBlockHash', 'proof', 'rewardAddr']);
-	//}
-}
-
-/*
-  toJSON() {
-    let o = {
-      chainLength: this.chainLength,
-      timestamp: this.timestamp,
-    };
-    if (this.isGenesisBlock()) {
-      // The genesis block does not contain a proof or transactions,
-      // but is the only block than can specify balances.
-      o.balances = Array.from(this.balances.entries());
-    } else {
-      // Other blocks must specify transactions and proof details.
-      o.transactions = Array.from(this.transactions.entries());
-      o.prevBlockHash = this.prevBlockHash;
-      o.proof = this.proof;
-      o.rewardAddr = this.rewardAddr;
-    }
-    return o;
-  }*/
+}
 
 /**
  * Returns the cryptographic hash of the current block.
- * The block is first converted to its serial form, so
- * any unimportant fields are ignored.
+ * Only the header is hashed, so any unimportant fields are ignored.
  *
  * @returns {String} - cryptographic hash of the block.
  */
 func (base Block) hashVal() string {
-	return sha256hash(base.serialize())
+	return sha256hash(base.serializeHeader())
 }
 
 /**
@@ -226,47 +379,109 @@ func (base Block) addTransaction(tx Transaction) bool {
 		fmt.Printf("Duplicate transaction %v.\n", tx.Id)
 		return false
 	}
-	if len(tx.Sig) == 0 {
+	if len(tx.Sig) == 0 && len(tx.Sigs) == 0 {
 		fmt.Printf("Unsigned transaction %v", tx.Sig)
 		return false
 	} else if !validSignatureTransaction(tx) {
 		fmt.Printf("Invalid signature for transaction %v.\n", tx.Id)
 		return false
-	} else if !tx.sufficientFunds(base) {
+	} else if !tx.validAt(base.ChainLength) {
+		fmt.Printf("Transaction %v is not valid at height %v.\n", tx.Id, base.ChainLength)
+		return false
+	} else if err := base.validatePayload(tx); err != nil {
+		fmt.Printf("Invalid payload in transaction %v: %v.\n", tx.Id, err)
+		return false
+	} else if err := base.checkOutputs(tx); err != nil {
+		fmt.Printf("Invalid outputs in transaction %v: %v.\n", tx.Id, err)
+		return false
+	}
+	released, err := base.checkHashLock(tx)
+	if err != nil {
+		fmt.Printf("Invalid hash time-lock in transaction %v: %v.\n", tx.Id, err)
+		return false
+	} else if base.config().utxoMode {
+		return base.addUTXOTransaction(tx)
+	} else if !tx.sufficientFunds(base, released) {
 		fmt.Printf("Insufficient gold for transaction %v.\n", tx.Id)
 		return false
 	}
 
 	// Checking and updating nonce value.
 	// This portion prevents replay attacks.
-	nonce := base.NextNonce[tx.From]
+	nonce := base.nextNonce(tx.From)
 	if tx.Nonce < nonce {
 		fmt.Printf("Replayed transaction %v.\n", tx.Id)
 		return false
 	} else if tx.Nonce > nonce {
-		// FIXME: Need to do something to handle this case more gracefully.
+		// Miners queue these until the gap is filled; see Miner.addTransaction.
 		fmt.Printf("Out of order transaction %v.\n", tx.Id)
 		return false
 	} else {
-		base.NextNonce[tx.From] = nonce + 1
+		base.ledger.setNextNonce(tx.From, nonce+1)
 	}
 
 	// Adding the transaction to the block
 	base.Transactions[tx.Id] = tx
 
-	// Taking gold from the sender
+	// Taking gold from the sender, after releasing any gold the
+	// transaction unlocks to it.
 	senderBalance := base.balanceOf(tx.From)
-	base.Balances[tx.From] = senderBalance - tx.totalOutputs()
+	base.ledger.setBalance(tx.From, senderBalance+released-tx.totalOutputs())
+	if tx.Lock != nil {
+		base.ledger.addLock(tx.Id, lockedFunds{*tx.Lock, tx.From})
+	} else if tx.Unlock != nil {
+		base.ledger.releaseLock(tx.Unlock.LockID)
+	}
 
 	// Giving gold to the specified output addresses
-	for address, amount := range tx.Outputs {
-		oldBalance := base.balanceOf(address)
-		base.Balances[address] = amount + oldBalance
+	for _, payment := range tx.payments() {
+		oldBalance := base.balanceOf(payment.Address)
+		base.ledger.setBalance(payment.Address, payment.Amount+oldBalance)
 	}
 
 	return true
 }
 
+/**
+ * Checks that a transaction pays its outputs the way this chain's mode
+ * expects: through IO in UTXO mode and through Outputs in account mode,
+ * never both, and never a negative amount or fee.
+ *
+ * @param {Transaction} tx - The transaction to check.
+ *
+ * @returns {error} - nil if the outputs are well-formed.
+ */
+func (base Block) checkOutputs(tx Transaction) error {
+	if base.config().utxoMode && len(tx.Outputs) > 0 {
+		return errors.New("Account outputs are not allowed in UTXO mode")
+	}
+	if !base.config().utxoMode && tx.IO != nil {
+		return errors.New("Transaction inputs are not allowed in account mode")
+	}
+	if tx.Fee < 0 {
+		return errors.New("Fee is negative")
+	}
+	for _, payment := range tx.payments() {
+		if payment.Amount < 0 {
+			return errors.New("Output amount is negative")
+		}
+	}
+	return nil
+}
+
+/**
+ * The size of the block body, used to enforce MAX_BLOCK_SIZE.
+ *
+ * @returns {Number} - The total size in bytes of the block's transactions.
+ */
+func (base Block) size() int {
+	size := 0
+	for _, tx := range base.Transactions {
+		size += tx.size()
+	}
+	return size
+}
+
 /**
  * When a block is received from another party, it does not include balances or a record of
  * the latest nonces for each client.  This method restores this information be wiping out
@@ -278,25 +493,49 @@ func (base Block) addTransaction(tx Transaction) bool {
  *
  * @returns {Boolean} - True if the block's transactions are all valid.
  */
-func (base Block) rerun(prevBlock Block) bool {
-	// Setting balances to the previous block's balances.
-	base.Balances = prevBlock.Balances
-	base.NextNonce = prevBlock.NextNonce
+func (base *Block) rerun(prevBlock Block) bool {
+	// Starting from the previous block's balances.
+	base.ledger = prevBlock.childLedger()
+	base.cfg = prevBlock.cfg
+	base.TotalSupply = prevBlock.TotalSupply + base.CoinbaseReward
+	base.accumulateWork(prevBlock)
 
 	// Adding coinbase reward for prevBlock.
-	winnerBalance := base.balanceOf(prevBlock.RewardAddr)
 	if prevBlock.RewardAddr != "" {
-		base.Balances[prevBlock.RewardAddr] = winnerBalance + prevBlock.totalRewards()
+		base.payReward(prevBlock)
 	}
 
-	// Re-adding all transactions.
-	txs := base.Transactions
+	// Verifying all signatures in parallel first.  Balances and nonces
+	// still have to be applied one transaction at a time below, which
+	// then finds every signature in the cache.
+	remaining := base.sortedTransactions()
+	if !verifySignatures(remaining) {
+		fmt.Printf("Block %v contains an invalid signature.\n", base.getID())
+		return false
+	}
+
+	// Re-adding all transactions, in nonce order for each sender.  A
+	// transaction may still depend on another one of the block, such as
+	// an output it spends in UTXO mode, so transactions that fail are
+	// retried as long as others are being added.
+	sort.SliceStable(remaining, func(i, j int) bool {
+		if remaining[i].From != remaining[j].From {
+			return remaining[i].From < remaining[j].From
+		}
+		return remaining[i].Nonce < remaining[j].Nonce
+	})
 	base.Transactions = make(map[string]Transaction)
-	for _, tx := range txs {
-		success := base.addTransaction(tx)
-		if !success {
+	for len(remaining) > 0 {
+		var failed []Transaction
+		for _, tx := range remaining {
+			if !base.addTransaction(tx) {
+				failed = append(failed, tx)
+			}
+		}
+		if len(failed) == len(remaining) {
 			return false
 		}
+		remaining = failed
 	}
 
 	return true
@@ -313,7 +552,49 @@ func (base Block) rerun(prevBlock Block) bool {
  * @returns {Number} - The available gold for the specified user.
  */
 func (base Block) balanceOf(addr string) int {
-	return base.Balances[addr]
+	if base.ledger == nil {
+		return 0
+	}
+	return base.ledger.balanceOf(addr)
+}
+
+/**
+ * Gets the nonce that the next transaction from an address must use.
+ *
+ * @param {String} addr - Address of a client.
+ *
+ * @returns {Number} - The next nonce for the specified user.
+ */
+func (base Block) nextNonce(addr string) int {
+	if base.ledger == nil {
+		return 0
+	}
+	return base.ledger.nextNonce(addr)
+}
+
+/**
+ * Gets the balance of every address as of this block.
+ *
+ * @returns {Object} - A new map of addresses to balances.
+ */
+func (base Block) allBalances() map[string]int {
+	if base.ledger == nil {
+		return make(map[string]int)
+	}
+	return base.ledger.allBalances()
+}
+
+/**
+ * Makes the ledger state of a new block that follows this one.  The
+ * ledger of this block can no longer be changed afterwards.
+ *
+ * @returns {ledgerState} - A state that shares this block's ledger.
+ */
+func (base Block) childLedger() *ledgerState {
+	if base.ledger == nil {
+		return newLedgerState()
+	}
+	return base.ledger.child()
 }
 
 /**
@@ -2,6 +2,8 @@ package main
 
 //const BigInteger = require('jsbn').BigInteger;
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
 	"math/big"
 )
@@ -20,10 +22,36 @@ var POW_BASE_TARGET = big.NewInt(0)
 
 const POW_LEADING_ZEROES uint = 15
 
+// The easiest target that retargeting may ever produce.
+const POW_LIMIT_LEADING_ZEROES uint = 8
+
+// Constants for difficulty retargeting.  The target is adjusted every
+// RETARGET_WINDOW blocks so that blocks arrive every TARGET_BLOCK_INTERVAL
+// milliseconds on average.
+const TARGET_BLOCK_INTERVAL int64 = 1000
+const RETARGET_WINDOW int = 10
+
+// Constants for validating block timestamps.  A block may not be more than
+// MAX_FUTURE_BLOCK_TIME milliseconds ahead of the receiver's clock, and may
+// not be older than the median timestamp of the last MEDIAN_TIME_BLOCKS blocks.
+const MAX_FUTURE_BLOCK_TIME int64 = 2 * 60 * 1000
+const MEDIAN_TIME_BLOCKS int = 11
+
 // Constants for mining rewards and default transaction fees
 const COINBASE_AMT_ALLOWED int = 25
 const DEFAULT_TX_FEE int = 1
 
+// Constants for the coinbase emission schedule.  The coinbase reward halves
+// every HALVING_INTERVAL blocks, but never drops below TAIL_EMISSION.
+// If MAX_SUPPLY is not 0, no reward may bring the total supply above it.
+const HALVING_INTERVAL int = 210
+const TAIL_EMISSION int = 0
+const MAX_SUPPLY int = 0
+
+// In UTXO mode, transactions spend explicit outputs of earlier transactions
+// instead of drawing on account balances.
+const UTXO_MODE bool = false
+
 // If a block is 6 blocks older than the current block, it is considered
 // confirmed, for no better reason than that is what Bitcoin does.
 // Note that the genesis block is always considered to be confirmed.
@@ -44,12 +72,54 @@ func main() {
 */
 
 type BlockChaincfg struct {
-	powTarget        *big.Int
-	blockClass       Block
-	transactionClass Transaction
-	coinbaseAmount   int
-	defaultTxFee     int
-	confirmedDepth   int
+	powTarget           *big.Int
+	powLimit            *big.Int
+	targetBlockInterval int64
+	retargetWindow      int
+	clock               Clock
+	blockClass          Block
+	transactionClass    Transaction
+	coinbaseAmount      int
+	halvingInterval     int
+	tailEmission        int
+	maxSupply           int
+	defaultTxFee        int
+	confirmedDepth      int
+	utxoMode            bool
+	maxPayloadSize      int
+	payloadTypes        map[string]PayloadValidator
+}
+
+// The configuration used by blocks that were not created from a BlockChain,
+// such as blocks received from the network before the genesis block.
+var defaultBlockChaincfg = newBlockChaincfg()
+
+/**
+ * Creates a configuration with the default values for every setting.
+ * Settings can be changed on the BlockChain before makeGenesis is called.
+ */
+func newBlockChaincfg() *BlockChaincfg {
+	cfg := new(BlockChaincfg)
+	cfg.coinbaseAmount = COINBASE_AMT_ALLOWED
+	cfg.halvingInterval = HALVING_INTERVAL
+	cfg.tailEmission = TAIL_EMISSION
+	cfg.maxSupply = MAX_SUPPLY
+	cfg.defaultTxFee = DEFAULT_TX_FEE
+	cfg.confirmedDepth = CONFIRMED_DEPTH
+	cfg.utxoMode = UTXO_MODE
+	cfg.maxPayloadSize = MAX_PAYLOAD_SIZE
+	cfg.payloadTypes = defaultPayloadTypes()
+
+	maxHash := big.NewInt(0)
+	if _, ok := maxHash.SetString("ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff", 16); !ok {
+		fmt.Printf("rip")
+	}
+	cfg.powTarget = new(big.Int).Rsh(maxHash, POW_LEADING_ZEROES)
+	cfg.powLimit = new(big.Int).Rsh(maxHash, POW_LIMIT_LEADING_ZEROES)
+	cfg.targetBlockInterval = TARGET_BLOCK_INTERVAL
+	cfg.retargetWindow = RETARGET_WINDOW
+	cfg.clock = systemClock{}
+	return cfg
 }
 
 type BlockChain struct {
@@ -70,7 +140,7 @@ func newBlockchain() *BlockChain {
 	blockchain.coinbaseAmount = COINBASE_AMT_ALLOWED
 	blockchain.defaultTxFee = DEFAULT_TX_FEE
 	blockchain.confirmedDepth = CONFIRMED_DEPTH
-	blockchain.cfg = new(BlockChaincfg)
+	blockchain.cfg = newBlockChaincfg()
 	return blockchain
 }
 
@@ -83,14 +153,8 @@ func makeGenesis(blockClass Block, transactionClass Transaction, clientBalanceMa
 	// Setting blockchain configuration
 	blockchain.cfg.blockClass = blockClass
 	blockchain.cfg.transactionClass = transactionClass
-	blockchain.cfg.coinbaseAmount = COINBASE_AMT_ALLOWED
-	blockchain.cfg.defaultTxFee = DEFAULT_TX_FEE
-	blockchain.cfg.confirmedDepth = CONFIRMED_DEPTH
-	if _, ok := POW_BASE_TARGET.SetString("ffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffffff", 16); ok {
-	} else {
-		fmt.Printf("rip")
-	}
-	blockchain.cfg.powTarget = POW_BASE_TARGET.Rsh(POW_BASE_TARGET, POW_LEADING_ZEROES)
+	// The remaining settings, including the proof-of-work target, were set by
+	// newBlockchain and may have been changed by the caller since.
 
 	// If startingBalances was specified, we initialize our balances to that object.
 	//BlockChain.balances = startingBalances //|| {};
@@ -103,10 +167,11 @@ func makeGenesis(blockClass Block, transactionClass Transaction, clientBalanceMa
 		  }
 		}*/
 	g := blockchain.makeEmptyBlock()
+	g.Timestamp = blockchain.cfg.clock.now()
 
 	// Initializing starting balances in the genesis block.
 	for address, balance := range clientBalanceMap {
-		g.Balances[address] = balance
+		g.setGenesisBalance(address, balance)
 	}
 
 	// If clientBalanceMap was specified, we set the genesis block for every client.
@@ -120,16 +185,82 @@ func makeGenesis(blockClass Block, transactionClass Transaction, clientBalanceMa
 
 /**
  * Converts a string representation of a block to a new Block instance.
+ * Balances and nonces are not part of the serialized form (except for the
+ * genesis balances), so block.rerun must be called to restore them.
  *
- * @param {Object} o - An object representing a block, but not necessarily an instance of Block.
+ * @param {[]byte} data - A block in the form produced by Block.serialize.
  *
  * @returns {Block}
  */
-func deserializeBlock(o Block) Block {
-	//if reflect.TypeOf(o) == reflect.TypeOf(blockchain.cfg.blockClass) {
-	return o
-	//}
+func deserializeBlock(data []byte) (Block, error) {
+	var msg blockMessage
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return Block{}, err
+	}
+
+	h := msg.Header
+	block := Block{
+		NotEmpty:       true,
+		PrevBlockHash:  h.PrevBlockHash,
+		Transactions:   make(map[string]Transaction),
+		ledger:         newLedgerState(),
+		ChainLength:    h.ChainLength,
+		Timestamp:      h.Timestamp,
+		RewardAddr:     h.RewardAddr,
+		Proof:          h.Proof,
+		CoinbaseReward: h.CoinbaseReward,
+	}
+	block.Target = big.NewInt(0)
+	if _, ok := block.Target.SetString(h.Target, 16); !ok {
+		return Block{}, errors.New("Invalid block target")
+	}
+	if block.isGenesisBlock() {
+		block.TotalWork = block.work()
+	}
+	for _, entry := range h.Balances {
+		block.setGenesisBalance(entry.Addr, entry.Balance)
+	}
+	for _, tx := range msg.Transactions {
+		block.Transactions[tx.Id] = tx
+	}
+
+	if !block.isGenesisBlock() && block.txRoot() != h.TxRoot {
+		return Block{}, errors.New("Transactions do not match block header")
+	}
+	return block, nil
+}
 
+/**
+ * Calculates the largest coinbase reward a block may claim.  The reward
+ * starts at coinbaseAmount and halves every halvingInterval blocks, but
+ * not below tailEmission.  With a maxSupply, the reward is cut so that the
+ * total supply never exceeds it.
+ *
+ * @param {Number} height - The chain length of the block.
+ * @param {Number} supply - The total supply before the block.
+ *
+ * @returns {Number} - The coinbase reward allowed for the block.
+ */
+func (cfg *BlockChaincfg) coinbaseRewardAt(height int, supply int) int {
+	reward := cfg.coinbaseAmount
+	if cfg.halvingInterval > 0 {
+		halvings := height / cfg.halvingInterval
+		if halvings >= 63 {
+			reward = 0
+		} else {
+			reward >>= uint(halvings)
+		}
+	}
+	if reward < cfg.tailEmission {
+		reward = cfg.tailEmission
+	}
+	if cfg.maxSupply > 0 && supply+reward > cfg.maxSupply {
+		reward = cfg.maxSupply - supply
+		if reward < 0 {
+			reward = 0
+		}
+	}
+	return reward
 }
 
 func (blockchain *BlockChain) makeEmptyBlock() *Block {
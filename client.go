@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sort"
 
 	emission "github.com/chuckpreslar/emission"
 )
@@ -14,13 +15,17 @@ type Client struct {
 	nonce                          int
 	pendingOutGoingTransactionsMap map[string]Transaction
 	pendingReceivedTransactionsMap map[string]Transaction
+	replacedTransactionsMap        map[string]string
 	address                        string
-	blocks                         map[string]Block
-	pendingBlocks                  map[string]Block
+	blocks                         BlockStore
+	pendingBlocks                  *orphanPool
 	lastBlock                      Block
 	lastConfirmedBlock             Block
 	emitter                        *emission.Emitter
 	fakeNet                        *FakeNet
+	// Derives the client's keys from a seed phrase, or nil if the client
+	// only has the one keypair.
+	wallet *HDWallet
 }
 
 /*
@@ -29,25 +34,40 @@ func (base Client) String() string {
 	return fmt.Sprintf("Name: %s, Address: %s\n", base.name, base.address)
 }*/
 
+/**
+ * Creates a client.  A client given an empty keypair gets a new key of
+ * DEFAULT_SIG_SCHEME; see newClientWithScheme to pick another scheme.
+ *
+ * @param {String} name - The client's name, used for debugging messages.
+ * @param {keypair} keypairClient - The client's keys, or an empty keypair.
+ * @param {Block} startingBlock - The genesis block, or an empty block.
+ * @param {FakeNet} fakeNet - The network the client uses.
+ */
 func newClient(name string, keypairClient keypair, startingBlock Block, fakeNet *FakeNet) *Client {
 	client := new(Client)
 	client.name = name
 
-	if keypairClient.pubKey.N == nil {
-		client.keypairClient = generateKeypair()
+	if keypairClient.isEmpty() {
+		kp, err := generateSchemeKeypair(DEFAULT_SIG_SCHEME)
+		if err != nil {
+			fmt.Println(err)
+		}
+		client.keypairClient = kp
 	} else {
 		client.keypairClient = keypairClient
 	}
 
-	client.address = calcAddress(&client.keypairClient.pubKey)
+	client.address = client.keypairClient.address()
 	client.nonce = 0
 
 	client.pendingOutGoingTransactionsMap = make(map[string]Transaction)
 	client.pendingReceivedTransactionsMap = make(map[string]Transaction)
+	// Maps the ID of a transaction replaced by bumpFee to its replacement.
+	client.replacedTransactionsMap = make(map[string]string)
 
 	// A map of all block hashes to the accepted blocks.
-	client.blocks = make(map[string]Block)
-	client.pendingBlocks = make(map[string]Block)
+	client.blocks = newMemBlockStore()
+	client.pendingBlocks = newOrphanPool()
 
 	if startingBlock.NotEmpty {
 		client.setGenesisBlock(startingBlock)
@@ -81,34 +101,97 @@ func (base *Client) setGenesisBlock(startingBlock Block) {
 		// up to lastBlock are considered pending.
 		base.lastBlock = startingBlock
 
-		base.blocks[startingBlock.getID()] = startingBlock
+		base.blocks.put(startingBlock)
+		base.blocks.setTip(startingBlock.getID())
+		base.scanBlock(startingBlock)
 	}
 }
 
 /**
  * The amount of gold available to the client, not counting any pending
  * transactions.  This getter looks at the last confirmed block, since
- * transactions in newer blocks may roll back.
+ * transactions in newer blocks may roll back.  The balances of every
+ * wallet address are added up.
  */
 func (base Client) confirmedBalance() int {
-	return base.lastConfirmedBlock.balanceOf(base.address)
+	var balance = 0
+	for _, addr := range base.walletAddresses() {
+		balance += base.lastConfirmedBlock.balanceOf(addr)
+	}
+	return balance
 }
 
 /**
  * Any gold received in the last confirmed block or before is considered
  * spendable, but any gold received more recently is not yet available.
  * However, any gold given by the client to other clients in unconfirmed
- * transactions is treated as unavailable.
+ * transactions is treated as unavailable.  The gold of every wallet
+ * address is added up; gold moved between them stays available.
  */
 func (base Client) availableGold() int {
+	if base.lastConfirmedBlock.config().utxoMode {
+		var available = 0
+		for _, out := range base.walletOutputs() {
+			available += out.Amount
+		}
+		return available
+	}
+
 	var pendingSpent = 0
 	for _, element := range base.pendingOutGoingTransactionsMap {
 		pendingSpent += element.totalOutputs()
+		for _, payment := range element.payments() {
+			if base.ownsAddress(payment.Address) {
+				pendingSpent -= payment.Amount
+			}
+		}
 	}
 
 	return base.confirmedBalance() - pendingSpent
 }
 
+/**
+ * Like availableGold, but only counts the main address, which every
+ * outgoing transaction pays from.  Gold that pending sweeps move to the
+ * main address is included.
+ */
+func (base Client) mainAddressGold() int {
+	if base.lastConfirmedBlock.config().utxoMode {
+		var available = 0
+		for _, out := range base.spendableOutputs() {
+			available += out.Amount
+		}
+		return available
+	}
+
+	var pendingSpent = 0
+	for _, element := range base.pendingOutGoingTransactionsMap {
+		if element.From == base.address {
+			pendingSpent += element.totalOutputs()
+		}
+		for _, payment := range element.payments() {
+			if payment.Address == base.address {
+				pendingSpent -= payment.Amount
+			}
+		}
+	}
+
+	return base.lastConfirmedBlock.balanceOf(base.address) - pendingSpent
+}
+
+/**
+ * Sweeps the other wallet addresses if the main address cannot pay the
+ * amount plus the fee on its own.
+ *
+ * @param {Number} amount - The amount of gold to pay.
+ * @param {Number} fee - The transaction fee of the payment.
+ */
+func (base *Client) fundMainAddress(amount int, fee int) {
+	if base.wallet != nil && amount+fee > base.mainAddressGold() {
+		base.sweepReceiveAddresses(fee)
+	}
+}
+
 /**
  * Broadcasts a transaction from the client giving gold to the clients
  * specified in 'outputs'. A transaction fee may be specified, which can
@@ -118,25 +201,105 @@ func (base Client) availableGold() int {
  *    amounts to pay.
  * @param {number} [fee] - The transaction fee reward to pay the miner.
  *
- * @returns {Transaction} - The posted transaction.
+ * @returns {Transaction} - The posted transaction, or an error if a recipient is malformed.
+ */
+func (base *Client) postTransaction(outputs map[string]int, fee int) (Transaction, error) {
+	return base.postScheduledTransaction(outputs, fee, 0, 0)
+}
+
+/**
+ * Broadcasts a transaction that only blocks above validAfterHeight and
+ * below expiresAtHeight may include.  A height of 0 means no limit.
+ *
+ * @param {Array} outputs - The list of outputs of other addresses and
+ *    amounts to pay.
+ * @param {number} fee - The transaction fee reward to pay the miner.
+ * @param {number} validAfterHeight - The lock-time height of the transaction.
+ * @param {number} expiresAtHeight - The height at which the transaction expires.
+ *
+ * @returns {Transaction} - The posted transaction, or an error if a recipient is malformed.
+ */
+func (base *Client) postScheduledTransaction(outputs map[string]int, fee int, validAfterHeight int, expiresAtHeight int) (Transaction, error) {
+	if err := validateRecipients(outputs); err != nil {
+		return Transaction{}, err
+	}
+	tx := base.newOutgoingTransaction(outputs, fee)
+	tx.ValidAfterHeight = validAfterHeight
+	tx.ExpiresAtHeight = expiresAtHeight
+	return base.broadcastTransaction(tx), nil
+}
+
+/**
+ * Broadcasts a transaction carrying a typed payload in its Data field.
+ * The payload is checked against the registered payload types first.
+ *
+ * @param {Array} outputs - The list of outputs of other addresses and
+ *    amounts to pay.
+ * @param {number} fee - The transaction fee reward to pay the miner.
+ * @param {String} payloadType - The type tag of the payload.
+ * @param {String} body - The body of the payload.
+ *
+ * @returns {Transaction} - The posted transaction, or an error for an invalid payload or recipient.
+ */
+func (base *Client) postPayloadTransaction(outputs map[string]int, fee int, payloadType string, body string) (Transaction, error) {
+	if err := validateRecipients(outputs); err != nil {
+		return Transaction{}, err
+	}
+	tx := base.newOutgoingTransaction(outputs, fee)
+	tx.Data = encodePayload(payloadType, body)
+	if err := base.lastBlock.validatePayload(*tx); err != nil {
+		// Giving back the nonce, since the transaction is never sent.
+		base.nonce--
+		return Transaction{}, err
+	}
+	return base.broadcastTransaction(tx), nil
+}
+
+/**
+ * Creates an unsigned transaction from the client with the next nonce.
+ * If the main address cannot pay for it, the gold of the other wallet
+ * addresses is swept to it first.
+ *
+ * @param {Array} outputs - The list of outputs of other addresses and
+ *    amounts to pay.
+ * @param {number} fee - The transaction fee reward to pay the miner.
+ *
+ * @returns {Transaction} - The unsigned transaction.
  */
-func (base *Client) postTransaction(outputs map[string]int, fee int) Transaction {
+func (base *Client) newOutgoingTransaction(outputs map[string]int, fee int) *Transaction {
 	var totalPayments = 0
 	for _, element := range outputs {
 		totalPayments += element
 	}
-	if totalPayments > base.availableGold() {
-		fmt.Printf("ERROR!!!, Request %d, but account only has %d\n", totalPayments, base.availableGold())
+	base.fundMainAddress(totalPayments, fee)
+	if totalPayments > base.mainAddressGold() {
+		fmt.Printf("ERROR!!!, Request %d, but account only has %d\n", totalPayments, base.mainAddressGold())
 	}
 
 	var tx *Transaction
 	var sig = []byte{0}
-	tx = newTransaction(base.address, base.nonce, base.keypairClient.pubKey, sig, outputs, fee, "")
-	signTransaction(base.keypairClient.privKey, tx)
+	if base.lastConfirmedBlock.config().utxoMode {
+		tx = newTransaction(base.address, base.nonce, base.keypairClient.pubKey, sig, nil, fee, "")
+		tx.IO = base.selectOutputs(outputs, fee)
+	} else {
+		tx = newTransaction(base.address, base.nonce, base.keypairClient.pubKey, sig, outputs, fee, "")
+	}
+	base.nonce++
+	return tx
+}
 
-	base.pendingOutGoingTransactionsMap[tx.Id] = *tx
+/**
+ * Signs a transaction, keeps it as pending until it is confirmed,
+ * and broadcasts it.
+ *
+ * @param {Transaction} tx - The unsigned transaction.
+ *
+ * @returns {Transaction} - The signed transaction.
+ */
+func (base *Client) broadcastTransaction(tx *Transaction) Transaction {
+	base.keyFor(tx.From).sign(tx)
 
-	base.nonce++
+	base.pendingOutGoingTransactionsMap[tx.Id] = *tx
 
 	txJSON, _ := json.Marshal(tx)
 	base.fakeNet.broadcast(POST_TRANSACTION, txJSON)
@@ -144,6 +307,70 @@ func (base *Client) postTransaction(outputs map[string]int, fee int) Transaction
 	return *tx
 }
 
+/**
+ * Replaces a pending transaction with a copy that pays a higher fee.  The
+ * copy keeps the nonce, so at most one of the two can be accepted, and
+ * miners replace the old version in their pools.  In UTXO mode, the extra
+ * fee is taken from the change output.
+ *
+ * @param {String} txID - The ID of the pending transaction, or of a transaction it replaced.
+ * @param {Number} fee - The new transaction fee.
+ *
+ * @returns {Transaction} - The replacement transaction, or an error.
+ */
+func (base *Client) bumpFee(txID string, fee int) (Transaction, error) {
+	txID = base.latestReplacement(txID)
+	old, ok := base.pendingOutGoingTransactionsMap[txID]
+	if !ok {
+		return Transaction{}, errors.New("Transaction is not pending")
+	}
+	if fee <= old.Fee {
+		return Transaction{}, errors.New("New fee must be higher than the old fee")
+	}
+	if old.IO == nil && fee-old.Fee > base.mainAddressGold() {
+		return Transaction{}, errors.New("Not enough gold to pay the higher fee")
+	}
+
+	tx := old
+	tx.Fee = fee
+	if old.IO != nil {
+		io := &TransactionIO{Inputs: old.IO.Inputs}
+		io.Outputs = append([]TxOutput(nil), old.IO.Outputs...)
+		last := len(io.Outputs) - 1
+		if last < 0 || io.Outputs[last].Address != base.address || io.Outputs[last].Amount < fee-old.Fee {
+			return Transaction{}, errors.New("Not enough change to pay the higher fee")
+		}
+		io.Outputs[last].Amount -= fee - old.Fee
+		if io.Outputs[last].Amount == 0 {
+			io.Outputs = io.Outputs[:last]
+		}
+		tx.IO = io
+	}
+
+	delete(base.pendingOutGoingTransactionsMap, old.Id)
+	replacement := base.broadcastTransaction(&tx)
+	base.replacedTransactionsMap[old.Id] = replacement.Id
+	fmt.Printf("%s: Replaced transaction %s with %s, fee %d\n", base.name, old.Id, replacement.Id, fee)
+	return replacement, nil
+}
+
+/**
+ * Follows the chain of replacements made by bumpFee.
+ *
+ * @param {String} txID - The ID of a transaction.
+ *
+ * @returns {String} - The ID of its latest replacement, or txID if it was not replaced.
+ */
+func (base Client) latestReplacement(txID string) string {
+	for {
+		next, ok := base.replacedTransactionsMap[txID]
+		if !ok {
+			return txID
+		}
+		txID = next
+	}
+}
+
 /*
 * @param {Block | Object} block - The block to add to the clients list of available blocks.
    *
@@ -158,61 +385,111 @@ func (base *Client) receiveBlock(block Block) (Block, error) {
 	// If we want to handle strings, we'll need a new function for that.
 	// Ignore the block if it has been received previously.
 
-	if _, ok := base.blocks[block.getID()]; ok {
+	if _, ok := base.getBlock(block.getID()); ok {
 		return block, errors.New("Block Recieved Previously")
 	}
+	if base.pendingBlocks.contains(block.getID()) {
+		return block, errors.New("Block is already waiting for its previous block")
+	}
+
+	// A genesis block carries no proof of work, so once the client has one,
+	// any other genesis block is rejected.
+	if block.isGenesisBlock() && base.lastBlock.NotEmpty {
+		return block, errors.New("Client already has a genesis block")
+	}
 
-	// First, make sure that the block has a valid proof.
+	// First, make sure that the block has a valid proof against a target no
+	// easier than the proof-of-work limit.  Blocks waiting for their previous
+	// block can only be checked this way, so this keeps free blocks out of
+	// the orphan pool.
+	if !block.isGenesisBlock() && (block.Target == nil || block.Target.Cmp(base.lastBlock.config().powLimit) > 0) {
+		return block, errors.New("Block target is easier than the proof-of-work limit")
+	}
 	if !block.hasValidProof() && !block.isGenesisBlock() {
 		return block, errors.New("Block does not have valid proof")
 	}
 
 	// Make sure that we have the previous blocks, unless it is the genesis block.
 	// If we don't have the previous blocks, request the missing blocks and exit.
-	prevBlock := base.blocks[block.PrevBlockHash]
-	if !prevBlock.NotEmpty && !block.isGenesisBlock() {
-		stuckBlocks := base.pendingBlocks[block.PrevBlockHash]
-
+	prevBlock, ok := base.getBlock(block.PrevBlockHash)
+	if !ok && !block.isGenesisBlock() {
 		// If this is the first time that we have identified this block as missing,
 		// send out a request for the block.
-		var stuckBlocksMap map[string]Block
-		if !stuckBlocks.NotEmpty {
+		if base.pendingBlocks.add(block, base.now()) {
 			base.requestMissingBlock(block)
-			stuckBlocksMap = make(map[string]Block)
 		}
-		stuckBlocksMap[block.getID()] = block
+		return block, errors.New("Block is waiting for its previous block")
 	}
 
-	if block.isGenesisBlock() {
+	// Restoring the balances and nonces, which are not sent over the network.
+	if !block.isGenesisBlock() {
+		if block.ChainLength != prevBlock.ChainLength+1 {
+			return block, errors.New("Block chain length does not follow its previous block")
+		}
+		if block.size() > MAX_BLOCK_SIZE {
+			return block, errors.New("Block is larger than the maximum block size")
+		}
+		if block.Target.Cmp(prevBlock.nextTarget(base.getBlock)) != 0 {
+			return block, errors.New("Block target does not match the expected difficulty")
+		}
+		if block.CoinbaseReward > prevBlock.config().coinbaseRewardAt(block.ChainLength, prevBlock.TotalSupply) {
+			return block, errors.New("Block claims more coinbase reward than the emission schedule allows")
+		}
+		if block.CoinbaseReward < 0 {
+			return block, errors.New("Block claims a negative coinbase reward")
+		}
+		if block.Timestamp > base.now()+MAX_FUTURE_BLOCK_TIME {
+			return block, errors.New("Block timestamp is too far in the future")
+		}
+		if block.Timestamp < prevBlock.medianTimePast(base.getBlock) {
+			return block, errors.New("Block timestamp is older than the median of recent blocks")
+		}
 		success := block.rerun(prevBlock)
 		if success == false {
 			return block, errors.New("Success is false")
 		}
 	}
 
-	base.blocks[block.getID()] = block
-	if base.lastBlock.ChainLength < block.ChainLength {
-		base.lastBlock = block
-		base.setLastConfirmed()
+	if err := base.blocks.put(block); err != nil {
+		return block, err
 	}
-
-	var unstuckBlocks []Block
-	if _, ok := base.pendingBlocks[block.getID()]; ok {
-		unstuckBlocks = append(unstuckBlocks, base.pendingBlocks[block.getID()])
+	if block.hasMoreWorkThan(base.lastBlock) {
+		base.switchChain(block)
 	}
 
-	delete(base.pendingBlocks, block.getID())
-
-	for _, block := range unstuckBlocks {
-		fmt.Printf("Processing unstuck block %s\n", block.getID())
-		base.receiveBlock(block)
+	// Connecting any blocks that were waiting for this one.  Each of them
+	// in turn connects the blocks waiting for it.
+	for _, unstuckBlock := range base.pendingBlocks.take(block.getID()) {
+		fmt.Printf("Processing unstuck block %s\n", unstuckBlock.getID())
+		base.receiveBlock(unstuckBlock)
 	}
 	return block, nil
 }
 
+/**
+ * Reads the clock of the blockchain the client follows, so that clients,
+ * miners and the genesis block always agree on the time.
+ *
+ * @returns {Number} - The time in milliseconds.
+ */
+func (base Client) now() int64 {
+	return base.lastBlock.config().clock.now()
+}
+
+/**
+ * Looks up an accepted block by its ID.
+ *
+ * @param {String} id - The ID of the block.
+ *
+ * @returns {Block} - The block, and whether it was found.
+ */
+func (base *Client) getBlock(id string) (Block, bool) {
+	return base.blocks.get(id)
+}
+
 type Message struct {
-	from    string
-	missing string
+	From    string
+	Missing string
 }
 
 /**
@@ -257,11 +534,9 @@ func (base Client) resendPendingTransactions() {
 func (base Client) provideMissingBlock(msg []byte) {
 	var message Message
 	json.Unmarshal([]byte(msg), &message)
-	if _, ok := base.blocks[message.missing]; ok {
-		fmt.Print("Providing missing block %s", message.missing)
-		newBlock := base.blocks[message.missing]
-
-		base.emitter.Emit(PROOF_FOUND, message.from, newBlock)
+	if newBlock, ok := base.getBlock(message.Missing); ok {
+		fmt.Printf("Providing missing block %s\n", message.Missing)
+		base.fakeNet.sendMessage(message.From, PROOF_FOUND, []byte(newBlock.serialize()))
 	}
 }
 
@@ -270,7 +545,7 @@ func (base Client) provideMissingBlock(msg []byte) {
  * also updating pending transactions according to this block.
  * Note that the genesis block is always considered to be confirmed.
  */
-func (base Client) setLastConfirmed() {
+func (base *Client) setLastConfirmed() {
 	block := base.lastBlock
 	confirmedBlockHeight := block.ChainLength - CONFIRMED_DEPTH
 
@@ -278,26 +553,77 @@ func (base Client) setLastConfirmed() {
 		confirmedBlockHeight = 0
 	}
 
-	//While loop in go
+	// Walking back along the heaviest chain, which ends in lastBlock.
 	for block.ChainLength > confirmedBlockHeight {
-		if _, ok := base.blocks[block.PrevBlockHash]; ok {
-			block = base.blocks[block.PrevBlockHash]
+		prevBlock, ok := base.getBlock(block.PrevBlockHash)
+		if !ok {
+			break
 		}
+		block = prevBlock
 	}
 	base.lastConfirmedBlock = block
 
 	// Update pending transactions according to the new last confirmed block.
 	for txID, tx := range base.pendingOutGoingTransactionsMap {
-		if base.lastConfirmedBlock.contains(tx) {
+		if base.lastConfirmedBlock.settles(tx) {
 			delete(base.pendingOutGoingTransactionsMap, txID)
 		}
 	}
+	base.dropExpiredTransactions()
+}
+
+/**
+ * Drops pending transactions that expired before the last confirmed block
+ * could include them.  In account mode, the nonce of an expired transaction
+ * is never used, so later pending transactions from the same address would
+ * wait forever.  Such a gap is filled with an empty transaction from that
+ * address that only pays the default fee; if no later transaction is
+ * pending, a nonce of the main address is simply reused.
+ */
+func (base *Client) dropExpiredTransactions() {
+	expiredNonces := make(map[string][]int)
+	for txID, tx := range base.pendingOutGoingTransactionsMap {
+		if tx.expiredAt(base.lastConfirmedBlock.ChainLength + 1) {
+			fmt.Printf("%s: Transaction %s expired\n", base.name, txID)
+			delete(base.pendingOutGoingTransactionsMap, txID)
+			if tx.IO == nil {
+				expiredNonces[tx.From] = append(expiredNonces[tx.From], tx.Nonce)
+			}
+		}
+	}
+
+	senders := make([]string, 0, len(expiredNonces))
+	for sender := range expiredNonces {
+		senders = append(senders, sender)
+	}
+	sort.Strings(senders)
+	for _, sender := range senders {
+		// Going from the highest nonce down, so that the nonces at the end
+		// are reused before any gaps are filled.
+		nonces := expiredNonces[sender]
+		sort.Sort(sort.Reverse(sort.IntSlice(nonces)))
+		for _, nonce := range nonces {
+			laterPending := false
+			for _, tx := range base.pendingOutGoingTransactionsMap {
+				if tx.IO == nil && tx.From == sender && tx.Nonce > nonce {
+					laterPending = true
+					break
+				}
+			}
+			if laterPending {
+				filler := newTransaction(sender, nonce, base.keyFor(sender).pubKey, []byte{0}, map[string]int{}, DEFAULT_TX_FEE, "")
+				base.broadcastTransaction(filler)
+			} else if sender == base.address && nonce < base.nonce {
+				base.nonce = nonce
+			}
+		}
+	}
 }
 
 func (base Client) showAllBalances() {
 	fmt.Print("Show all balances:")
 
-	for id, balance := range base.lastConfirmedBlock.Balances {
+	for id, balance := range base.lastConfirmedBlock.allBalances() {
 		fmt.Printf("%s: %d\n", id, balance)
 	}
 }
@@ -314,10 +640,8 @@ func (base Client) log(msg string) {
 func (base Client) showBlockChain() {
 	block := base.lastBlock
 	fmt.Print("BLOCKCHAIN:")
-	for !block.NotEmpty {
+	for block.NotEmpty {
 		fmt.Printf("%s\n", block.getID())
-		if _, ok := base.blocks[block.PrevBlockHash]; ok {
-			block = base.blocks[block.PrevBlockHash]
-		}
+		block, _ = base.getBlock(block.PrevBlockHash)
 	}
 }
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// A Clock tells the time in milliseconds since the Unix epoch.
+// Clients and miners read the time through the Clock of the blockchain
+// configuration, so that simulations can replace it with a VirtualClock.
+type Clock interface {
+	now() int64
+}
+
+// systemClock reads the time of the machine, like Date.now() does.
+type systemClock struct{}
+
+func (base systemClock) now() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// VirtualClock only moves when it is told to, which makes simulations
+// independent of how fast the machine running them is.
+type VirtualClock struct {
+	mutex sync.Mutex
+	time  int64
+}
+
+/**
+ * Creates a virtual clock.
+ *
+ * @param {Number} start - The starting time in milliseconds.
+ */
+func newVirtualClock(start int64) *VirtualClock {
+	clock := new(VirtualClock)
+	clock.time = start
+	return clock
+}
+
+func (base *VirtualClock) now() int64 {
+	base.mutex.Lock()
+	defer base.mutex.Unlock()
+	return base.time
+}
+
+/**
+ * Moves the clock forward.
+ *
+ * @param {Number} ms - The number of milliseconds to advance the clock by.
+ */
+func (base *VirtualClock) advance(ms int64) {
+	base.mutex.Lock()
+	defer base.mutex.Unlock()
+	base.time += ms
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"math"
+	"math/big"
+	"testing"
+)
+
+// Stamps the block and searches for a valid proof, then sends the block
+// through the wire format, the way other clients receive it.
+func solveBlock(t *testing.T, block *Block) Block {
+	block.Timestamp = systemClock{}.now()
+	for !block.hasValidProof() {
+		block.Proof++
+	}
+	received, err := deserializeBlock([]byte(block.serialize()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return received
+}
+
+func newTestChain(balances map[string]int) (*BlockChain, *Client, *Block) {
+	bc := newBlockchain()
+	client := newClient("Alice", keypair{}, Block{}, newFakeNet())
+	balances[client.address] = 100
+	genesis := makeGenesis(Block{}, Transaction{}, balances, map[string]*Client{client.address: client}, bc)
+	return bc, client, genesis
+}
+
+func TestForgedGenesisDoesNotReplaceChain(t *testing.T) {
+	bc, client, genesis := newTestChain(map[string]int{})
+	block := solveBlock(t, genesis.makeBlock(client.address, client.getBlock))
+	if _, err := client.receiveBlock(block); err != nil {
+		t.Fatal(err)
+	}
+
+	forged := bc.makeEmptyBlock()
+	forged.Target = big.NewInt(1)
+	forged.setGenesisBalance("attacker", 1000000)
+	received, err := deserializeBlock([]byte(forged.serialize()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.receiveBlock(received); err == nil {
+		t.Fatal("forged genesis block was accepted")
+	}
+	if received.hasMoreWorkThan(client.lastBlock) {
+		t.Fatal("genesis block competes with an existing chain")
+	}
+	if client.lastBlock.getID() != block.getID() {
+		t.Fatal("client switched away from its chain")
+	}
+}
+
+func TestCoinbaseRewardBounds(t *testing.T) {
+	_, client, genesis := newTestChain(map[string]int{"victim": 100})
+	for _, reward := range []int{-90, genesis.config().coinbaseRewardAt(1, genesis.TotalSupply) + 1} {
+		block := genesis.makeBlock("victim", client.getBlock)
+		block.CoinbaseReward = reward
+		if _, err := client.receiveBlock(solveBlock(t, block)); err == nil {
+			t.Fatal("block with a coinbase reward of", reward, "was accepted")
+		}
+	}
+	if client.lastBlock.getID() != genesis.getID() {
+		t.Fatal("client switched to a block with an invalid coinbase reward")
+	}
+}
+
+func TestNegativeFeeAndOverflowingOutputs(t *testing.T) {
+	_, client, genesis := newTestChain(map[string]int{})
+	block := genesis.makeBlock("miner", client.getBlock)
+	negativeFee := newTransaction(client.address, 0, client.keypairClient.pubKey, nil, map[string]int{"bob": 1100}, -1000, "")
+	overflow := newTransaction(client.address, 0, client.keypairClient.pubKey, nil, map[string]int{"bob": math.MaxInt/2 + 1, "carol": math.MaxInt/2 + 1}, 1, "")
+	for _, tx := range []*Transaction{negativeFee, overflow} {
+		client.keypairClient.sign(tx)
+		if block.addTransaction(*tx) {
+			t.Fatal("transaction creating gold was accepted")
+		}
+	}
+	miner := newMiner("Minnie", keypair{}, *genesis, newFakeNet())
+	if miner.admitTransaction(*negativeFee) {
+		t.Fatal("miner pooled a transaction with a negative fee")
+	}
+}
+
+func TestOversizedBlockRejected(t *testing.T) {
+	_, client, genesis := newTestChain(map[string]int{})
+	block := genesis.makeBlock(client.address, client.getBlock)
+	for nonce := 0; block.size() <= MAX_BLOCK_SIZE; nonce++ {
+		tx := newTransaction(client.address, nonce, client.keypairClient.pubKey, nil, map[string]int{}, 0, "")
+		client.keypairClient.sign(tx)
+		if !block.addTransaction(*tx) {
+			t.Fatal("could not fill the block")
+		}
+	}
+	if _, err := client.receiveBlock(solveBlock(t, block)); err == nil {
+		t.Fatal("oversized block was accepted")
+	}
+}
+
+func TestOutputsMatchChainMode(t *testing.T) {
+	_, client, genesis := newTestChain(map[string]int{"bob": 100})
+	block := genesis.makeBlock(client.address, client.getBlock)
+	for _, tx := range []*Transaction{
+		newTransaction(client.address, 0, client.keypairClient.pubKey, nil, map[string]int{"bob": 90}, 1, ""),
+		newTransaction(client.address, 0, client.keypairClient.pubKey, nil, map[string]int{"bob": -50}, 1, ""),
+	} {
+		if tx.Outputs["bob"] > 0 {
+			tx.IO = &TransactionIO{}
+		}
+		client.keypairClient.sign(tx)
+		if block.addTransaction(*tx) {
+			t.Fatal("malformed account-mode transaction was accepted")
+		}
+	}
+	if block.balanceOf(client.address) != 100 || block.balanceOf("bob") != 100 {
+		t.Fatal("balances changed")
+	}
+
+	bc := newBlockchain()
+	bc.cfg.utxoMode = true
+	utxoClient := newClient("Carol", keypair{}, Block{}, newFakeNet())
+	utxoGenesis := makeGenesis(Block{}, Transaction{}, map[string]int{utxoClient.address: 100}, map[string]*Client{utxoClient.address: utxoClient}, bc)
+	tx := newTransaction(utxoClient.address, 0, utxoClient.keypairClient.pubKey, nil, map[string]int{"bob": 90}, 1, "")
+	tx.IO = utxoClient.selectOutputs(map[string]int{}, 1)
+	utxoClient.keypairClient.sign(tx)
+	utxoBlock := utxoGenesis.makeBlock(utxoClient.address, utxoClient.getBlock)
+	if utxoBlock.addTransaction(*tx) {
+		t.Fatal("UTXO-mode transaction with account outputs was accepted")
+	}
+
+	// A negative fee would let the outputs exceed the inputs.
+	tx = newTransaction(utxoClient.address, 0, utxoClient.keypairClient.pubKey, nil, nil, -900, "")
+	tx.IO = &TransactionIO{Outputs: []TxOutput{{utxoClient.address, 1000}}}
+	for op := range utxoClient.spendableOutputs() {
+		tx.IO.Inputs = append(tx.IO.Inputs, op)
+	}
+	utxoClient.keypairClient.sign(tx)
+	if utxoBlock.addTransaction(*tx) {
+		t.Fatal("UTXO-mode transaction with a negative fee was accepted")
+	}
+}
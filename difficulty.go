@@ -0,0 +1,59 @@
+package main
+
+import (
+	"math/big"
+)
+
+// Looks up a block by its ID, returning false if the block is unknown.
+type blockLookup func(id string) (Block, bool)
+
+/**
+ * Calculates the target that the block following this one must use.
+ * Every retargetWindow blocks, the target is scaled by how long the last
+ * window actually took compared to how long it should have taken.
+ * A single adjustment is limited to a factor of 4 in either direction,
+ * and the target never becomes easier than powLimit.
+ *
+ * @param {Function} getBlock - Looks up ancestors of this block.
+ *
+ * @returns {big.Int} - The expected target of the next block.
+ */
+func (base Block) nextTarget(getBlock blockLookup) *big.Int {
+	cfg := base.config()
+	height := base.ChainLength + 1
+	if cfg.retargetWindow <= 0 || height%cfg.retargetWindow != 0 {
+		return base.Target
+	}
+
+	// Finding the first block of the window.
+	first := base
+	intervals := 0
+	for intervals < cfg.retargetWindow && !first.isGenesisBlock() {
+		prevBlock, ok := getBlock(first.PrevBlockHash)
+		if !ok {
+			break
+		}
+		first = prevBlock
+		intervals++
+	}
+
+	// Blocks without timestamps give no information about the block rate.
+	if intervals == 0 || first.Timestamp == 0 || base.Timestamp == 0 {
+		return base.Target
+	}
+
+	expected := int64(intervals) * cfg.targetBlockInterval
+	actual := base.Timestamp - first.Timestamp
+	if actual < expected/4 {
+		actual = expected / 4
+	} else if actual > expected*4 {
+		actual = expected * 4
+	}
+
+	target := new(big.Int).Mul(base.Target, big.NewInt(actual))
+	target.Div(target, big.NewInt(expected))
+	if target.Cmp(cfg.powLimit) > 0 {
+		target.Set(cfg.powLimit)
+	}
+	return target
+}
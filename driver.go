@@ -2,25 +2,73 @@ package main
 
 import (
 	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
 	"time"
 )
 
+// The simulation keeps the keys of its clients and miners in KEYSTORE_DIR.
+// The keystores are encrypted with the passphrase in the environment
+// variable PASSPHRASE_ENV, or with SIMULATION_PASSPHRASE if it is not set.
+const KEYSTORE_DIR = "keystore"
+const PASSPHRASE_ENV = "DRAGONCOIN_PASSPHRASE"
+const SIMULATION_PASSPHRASE = "dragoncoin simulation"
+
+// New keys are made with the signature scheme named in SIG_SCHEME_ENV,
+// or with DEFAULT_SIG_SCHEME if it is not set.
+const SIG_SCHEME_ENV = "DRAGONCOIN_SIG_SCHEME"
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "swap" {
+		atomicSwapSimulation()
+		return
+	}
+
 	fmt.Println("Starting simulation.  This may take a moment...")
 
 	fakeNet := newFakeNet()
 
-	// Clients
-	emptyKeys := keypair{}
+	// Keys are kept in encrypted keystores, so that every run uses
+	// the same clients and miners.
 	emptyBlock := Block{}
 	emptyTransaction := Transaction{}
-	alice := newClient("Alice", emptyKeys, emptyBlock, fakeNet)
-	bob := newClient("Bob", emptyKeys, emptyBlock, fakeNet)
-	charlie := newClient("Charlie", emptyKeys, emptyBlock, fakeNet)
+	passphrase := os.Getenv(PASSPHRASE_ENV)
+	if passphrase == "" {
+		passphrase = SIMULATION_PASSPHRASE
+	}
+	scheme := os.Getenv(SIG_SCHEME_ENV)
+	if scheme == "" {
+		scheme = DEFAULT_SIG_SCHEME
+	}
+	keystorePath := func(name string) string {
+		return filepath.Join(KEYSTORE_DIR, strings.ToLower(name)+".json")
+	}
+	loadClient := func(name string, startingBlock Block) *Client {
+		client, err := newClientWithKeystore(name, keystorePath(name), passphrase, scheme, startingBlock, fakeNet)
+		if err != nil {
+			fmt.Printf("Cannot open keystore of %s: %v\n", name, err)
+			os.Exit(1)
+		}
+		return client
+	}
+	loadMiner := func(name string, startingBlock Block) *Miner {
+		miner, err := newMinerWithKeystore(name, keystorePath(name), passphrase, scheme, startingBlock, fakeNet)
+		if err != nil {
+			fmt.Printf("Cannot open keystore of %s: %v\n", name, err)
+			os.Exit(1)
+		}
+		return miner
+	}
+
+	// Clients
+	alice := loadClient("Alice", emptyBlock)
+	bob := loadClient("Bob", emptyBlock)
+	charlie := loadClient("Charlie", emptyBlock)
 
 	// Miners
-	minnie := newMiner("Minnie", emptyKeys, emptyBlock, fakeNet)
-	mickey := newMiner("Mickey", emptyKeys, emptyBlock, fakeNet)
+	minnie := loadMiner("Minnie", emptyBlock)
+	mickey := loadMiner("Mickey", emptyBlock)
 
 	// Creating genesis block
 	blockchain := newBlockchain()
@@ -41,7 +89,7 @@ func main() {
 	)
 	// Late miner - Donald has more mining power, represented by the miningRounds.
 	// (Mickey and Minnie have the default of 2000 rounds).
-	donald := newMiner("Donald", emptyKeys, *genesis, fakeNet)
+	donald := loadMiner("Donald", *genesis)
 	donald.miningRounds = 3000
 
 	showBalances := func(client Client) {
@@ -46,18 +46,24 @@ func (base FakeNet) broadcast(message string, jsonObject []byte) {
  * @param {Object} o - payload of the message
  */
 func (base FakeNet) sendMessage(address string, message string, jsonObject []byte) {
-	if message == "POST_TRANSACTION" {
+	if _, ok := base.clients[address]; !ok {
+		return
+	}
+	if message == MISSING_BLOCK {
+		base.clients[address].emitter.Emit(message, jsonObject)
+	} else if message == POST_TRANSACTION {
 		var tx Transaction
 		err := json.Unmarshal(jsonObject, &tx)
 		if err != nil {
 			fmt.Printf(`Error tx in sendMessage is %s`, err)
+			return
 		}
 		base.clients[address].emitter.Emit(message, tx)
 	} else {
-		var block Block
-		err := json.Unmarshal(jsonObject, &block)
+		block, err := deserializeBlock(jsonObject)
 		if err != nil {
 			fmt.Printf(`Error block in sendMessage is %s`, err)
+			return
 		}
 		base.clients[address].emitter.Emit(message, block)
 	}
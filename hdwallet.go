@@ -0,0 +1,400 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Constants for mnemonic seed phrases.  A phrase encodes HD_ENTROPY_SIZE
+// random bytes, one word per byte, followed by one checksum word.
+const HD_ENTROPY_SIZE int = 16
+const HD_SEED_SALT = "dragoncoin mnemonic"
+const HD_SEED_ITERATIONS int = 2048
+const HD_SEED_SIZE int = 64
+
+// Wallet keys are Ed25519 keys derived along m/44'/HD_COIN_TYPE'/0'/0'/i',
+// where i is the index of the address.  Every derivation step is hardened.
+const HD_MASTER_KEY = "ed25519 seed"
+const HD_PURPOSE uint32 = 44
+const HD_COIN_TYPE uint32 = 7337
+const HD_HARDENED uint32 = 0x80000000
+
+// When recovering a wallet, and as new blocks arrive, addresses are derived
+// until HD_GAP_LIMIT addresses in a row have never been used on the chain.
+const HD_GAP_LIMIT int = 20
+
+// hdKey is a private key and chain code of the derivation tree.
+type hdKey struct {
+	key       []byte
+	chainCode []byte
+}
+
+// HDWallet derives the keys of a client from a mnemonic seed phrase.
+// The first issued keys belong to the client; the keys derived after
+// them are only kept to recognize addresses found on the chain.
+type HDWallet struct {
+	account hdKey
+	derived []keypair
+	issued  int
+}
+
+/**
+ * Creates a new random mnemonic seed phrase.
+ *
+ * @returns {String} - The seed phrase.
+ */
+func newMnemonic() (string, error) {
+	entropy := make([]byte, HD_ENTROPY_SIZE)
+	if _, err := rand.Read(entropy); err != nil {
+		return "", err
+	}
+	checksum := sha256.Sum256(entropy)
+	words := make([]string, 0, HD_ENTROPY_SIZE+1)
+	for _, b := range append(entropy, checksum[0]) {
+		words = append(words, MNEMONIC_WORDS[b])
+	}
+	return strings.Join(words, " "), nil
+}
+
+/**
+ * Checks the words and checksum of a mnemonic seed phrase.
+ *
+ * @param {String} mnemonic - The seed phrase.
+ *
+ * @returns {[]byte} - The random bytes the phrase encodes, or an error for a mistyped phrase.
+ */
+func mnemonicEntropy(mnemonic string) ([]byte, error) {
+	words := strings.Fields(strings.ToLower(mnemonic))
+	if len(words) != HD_ENTROPY_SIZE+1 {
+		return nil, errors.New("Seed phrase has the wrong number of words")
+	}
+	raw := make([]byte, 0, len(words))
+	for _, word := range words {
+		index := -1
+		for i, w := range MNEMONIC_WORDS {
+			if w == word {
+				index = i
+				break
+			}
+		}
+		if index == -1 {
+			return nil, errors.New("Unknown word in seed phrase: " + word)
+		}
+		raw = append(raw, byte(index))
+	}
+	entropy := raw[:HD_ENTROPY_SIZE]
+	checksum := sha256.Sum256(entropy)
+	if raw[HD_ENTROPY_SIZE] != checksum[0] {
+		return nil, errors.New("Seed phrase checksum does not match")
+	}
+	return entropy, nil
+}
+
+/**
+ * Creates the wallet of a mnemonic seed phrase.  The optional passphrase
+ * is mixed into the seed, so the same phrase with another passphrase gives
+ * an unrelated wallet.
+ *
+ * @param {String} mnemonic - The seed phrase.
+ * @param {String} passphrase - The passphrase, which may be empty.
+ *
+ * @returns {HDWallet} - The wallet, with no keys derived yet.
+ */
+func newHDWallet(mnemonic string, passphrase string) (*HDWallet, error) {
+	if _, err := mnemonicEntropy(mnemonic); err != nil {
+		return nil, err
+	}
+	normalized := strings.Join(strings.Fields(strings.ToLower(mnemonic)), " ")
+	seed := pbkdf2.Key([]byte(normalized), []byte(HD_SEED_SALT+passphrase), HD_SEED_ITERATIONS, HD_SEED_SIZE, sha512.New)
+
+	wallet := new(HDWallet)
+	wallet.account = hdMaster(seed).
+		child(HD_PURPOSE).
+		child(HD_COIN_TYPE).
+		child(0).
+		child(0)
+	return wallet, nil
+}
+
+func hdMaster(seed []byte) hdKey {
+	mac := hmac.New(sha512.New, []byte(HD_MASTER_KEY))
+	mac.Write(seed)
+	sum := mac.Sum(nil)
+	return hdKey{sum[:32], sum[32:]}
+}
+
+// Derives the hardened child with the given index, as in SLIP-0010.
+func (base hdKey) child(index uint32) hdKey {
+	data := make([]byte, 0, 1+len(base.key)+4)
+	data = append(data, 0)
+	data = append(data, base.key...)
+	data = binary.BigEndian.AppendUint32(data, index|HD_HARDENED)
+	mac := hmac.New(sha512.New, base.chainCode)
+	mac.Write(data)
+	sum := mac.Sum(nil)
+	return hdKey{sum[:32], sum[32:]}
+}
+
+/**
+ * Derives the key of the address with the given index.
+ *
+ * @param {Number} index - The index of the address.
+ *
+ * @returns {keypair} - The derived keypair.
+ */
+func (base *HDWallet) deriveKey(index int) keypair {
+	for len(base.derived) <= index {
+		key := base.account.child(uint32(len(base.derived)))
+		base.derived = append(base.derived, keypair{signer: ed25519Signer{ed25519.NewKeyFromSeed(key.key)}})
+	}
+	return base.derived[index]
+}
+
+/**
+ * Issues the key of the next unused index.
+ *
+ * @returns {keypair} - The new keypair.
+ */
+func (base *HDWallet) nextKey() keypair {
+	kp := base.deriveKey(base.issued)
+	base.issued++
+	return kp
+}
+
+/**
+ * Returns the issued keys, in order of their index.
+ */
+func (base *HDWallet) keys() []keypair {
+	return base.derived[:base.issued]
+}
+
+/**
+ * Returns the addresses of every issued key, in order of their index.
+ */
+func (base *HDWallet) addresses() []string {
+	addresses := make([]string, 0, base.issued)
+	for _, kp := range base.keys() {
+		addresses = append(addresses, kp.address())
+	}
+	return addresses
+}
+
+/**
+ * Issues keys up to the last used one among the issued keys and the
+ * HD_GAP_LIMIT keys after them.  The window moves on past each used
+ * address, so a longer run of used addresses is found in full.
+ *
+ * @param {Object} used - The set of addresses used on the chain.
+ *
+ * @returns {Number} - The number of issued keys.
+ */
+func (base *HDWallet) issueUsed(used map[string]bool) int {
+	lastUsed := base.issued - 1
+	for index := base.issued; index-lastUsed <= HD_GAP_LIMIT; index++ {
+		if used[base.deriveKey(index).address()] {
+			lastUsed = index
+		}
+	}
+	for base.issued <= lastUsed {
+		base.nextKey()
+	}
+	return base.issued
+}
+
+/**
+ * Creates a client whose keys are derived from a mnemonic seed phrase.
+ * The first derived address becomes the client's main address.  The
+ * chain is scanned for the wallet's other addresses when the client gets
+ * its genesis block, loads a stored chain or accepts new blocks, so a
+ * wallet can be recovered from its seed phrase alone.
+ *
+ * @param {String} name - The client's name, used for debugging messages.
+ * @param {String} mnemonic - The seed phrase.
+ * @param {String} passphrase - The seed passphrase, which may be empty.
+ * @param {Block} startingBlock - The genesis block, or an empty block.
+ * @param {FakeNet} fakeNet - The network the client uses.
+ */
+func newHDClient(name string, mnemonic string, passphrase string, startingBlock Block, fakeNet *FakeNet) (*Client, error) {
+	wallet, err := newHDWallet(mnemonic, passphrase)
+	if err != nil {
+		return nil, err
+	}
+	client := newClient(name, wallet.nextKey(), startingBlock, fakeNet)
+	client.wallet = wallet
+	client.scanWallet()
+	return client, nil
+}
+
+/**
+ * Derives a new address for receiving gold.  A client without a wallet
+ * only has its one address.
+ *
+ * @returns {String} - The new address.
+ */
+func (base *Client) newReceiveAddress() string {
+	if base.wallet == nil {
+		return base.address
+	}
+	return base.wallet.nextKey().address()
+}
+
+/**
+ * Returns every address of the client.
+ */
+func (base Client) walletAddresses() []string {
+	if base.wallet == nil {
+		return []string{base.address}
+	}
+	return base.wallet.addresses()
+}
+
+/**
+ * Determines whether an address belongs to the client.
+ */
+func (base Client) ownsAddress(addr string) bool {
+	for _, own := range base.walletAddresses() {
+		if own == addr {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * Returns the keypair of one of the client's addresses.
+ *
+ * @param {String} addr - The address.
+ *
+ * @returns {keypair} - The keypair, or the client's main keypair if the address is not its own.
+ */
+func (base Client) keyFor(addr string) keypair {
+	if base.wallet != nil {
+		for _, kp := range base.wallet.keys() {
+			if kp.address() == addr {
+				return kp
+			}
+		}
+	}
+	return base.keypairClient
+}
+
+/**
+ * Scans the client's chain and issues wallet addresses until HD_GAP_LIMIT
+ * addresses in a row were never used.  An address counts as used once it
+ * has had a balance or appears in any transaction.
+ *
+ * @returns {Number} - The number of addresses the wallet has after the scan.
+ */
+func (base *Client) scanWallet() int {
+	if base.wallet == nil {
+		return 1
+	}
+	used := make(map[string]bool)
+	for block := base.lastBlock; block.NotEmpty; {
+		for addr := range block.usedAddresses() {
+			used[addr] = true
+		}
+		prevBlock, ok := base.getBlock(block.PrevBlockHash)
+		if !ok {
+			break
+		}
+		block = prevBlock
+	}
+	return base.wallet.issueUsed(used)
+}
+
+/**
+ * Issues the wallet addresses that a newly accepted block uses.
+ *
+ * @param {Block} block - A block of the client's chain.
+ */
+func (base *Client) scanBlock(block Block) {
+	if base.wallet != nil {
+		base.wallet.issueUsed(block.usedAddresses())
+	}
+}
+
+/**
+ * Collects every address that appears in the block.
+ */
+func (base Block) usedAddresses() map[string]bool {
+	used := make(map[string]bool)
+	if base.isGenesisBlock() {
+		for addr := range base.allBalances() {
+			used[addr] = true
+		}
+	}
+	for _, tx := range base.Transactions {
+		used[tx.From] = true
+		for _, payment := range tx.payments() {
+			used[payment.Address] = true
+		}
+		if tx.Lock != nil {
+			used[tx.Lock.Recipient] = true
+		}
+	}
+	if base.RewardAddr != "" {
+		used[base.RewardAddr] = true
+	}
+	return used
+}
+
+/**
+ * Moves the confirmed gold of every other wallet address to the client's
+ * main address, so that it can be spent with postTransaction.
+ *
+ * @param {Number} fee - The transaction fee paid by each transfer.
+ *
+ * @returns {Array} - The posted transactions.
+ */
+func (base *Client) sweepReceiveAddresses(fee int) []Transaction {
+	var swept []Transaction
+	for _, addr := range base.walletAddresses() {
+		if addr == base.address || base.hasPendingFrom(addr) {
+			continue
+		}
+		kp := base.keyFor(addr)
+		tx := newTransaction(addr, base.lastBlock.nextNonce(addr), kp.pubKey, []byte{0}, map[string]int{}, fee, "")
+		if base.lastConfirmedBlock.config().utxoMode {
+			io := new(TransactionIO)
+			total := 0
+			for op, out := range base.lastConfirmedBlock.ledger.allUTXOs() {
+				if out.Address == addr {
+					io.Inputs = append(io.Inputs, op)
+					total += out.Amount
+				}
+			}
+			if total <= fee {
+				continue
+			}
+			io.Outputs = []TxOutput{{base.address, total - fee}}
+			tx.IO = io
+			tx.Outputs = nil
+		} else {
+			balance := base.lastConfirmedBlock.balanceOf(addr)
+			if balance <= fee {
+				continue
+			}
+			tx.Outputs[base.address] = balance - fee
+		}
+		swept = append(swept, base.broadcastTransaction(tx))
+	}
+	return swept
+}
+
+func (base Client) hasPendingFrom(addr string) bool {
+	for _, tx := range base.pendingOutGoingTransactionsMap {
+		if tx.From == addr {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// HashLock locks an amount for a recipient.  The recipient may claim it by
+// revealing a preimage whose SHA-256 hash is Hash, in any block below
+// TimeoutHeight.  From TimeoutHeight on, only the sender may take it back.
+type HashLock struct {
+	Recipient     string
+	Amount        int
+	Hash          string
+	TimeoutHeight int
+}
+
+// HashUnlock releases the funds locked by the transaction LockID.  It is a
+// claim if the Preimage is set, and a refund otherwise.
+type HashUnlock struct {
+	LockID   string
+	Preimage string `json:",omitempty"`
+}
+
+// lockedFunds is a hash time-lock as stored in the ledger.
+type lockedFunds struct {
+	HashLock
+	Sender string
+}
+
+/**
+ * Checks the hash time-lock parts of a transaction against the block it
+ * is being added to.  Locks must have a valid hash and a timeout above
+ * the block.  Claims must come from the recipient with the right preimage
+ * before the timeout, and refunds from the sender after it.
+ *
+ * @param {Transaction} tx - The transaction to check.
+ *
+ * @returns {Number} - The amount the transaction releases to its sender, or an error.
+ */
+func (base Block) checkHashLock(tx Transaction) (int, error) {
+	if tx.Lock != nil && tx.Unlock != nil {
+		return 0, errors.New("Transaction cannot both lock and unlock funds")
+	}
+	if (tx.Lock != nil || tx.Unlock != nil) && base.config().utxoMode {
+		return 0, errors.New("Hash time-locks are not supported in UTXO mode")
+	}
+
+	if lock := tx.Lock; lock != nil {
+		if lock.Amount <= 0 || lock.Recipient == "" {
+			return 0, errors.New("Invalid hash time-lock")
+		}
+		if hash, err := hex.DecodeString(lock.Hash); err != nil || len(hash) != 32 {
+			return 0, errors.New("Hash time-lock needs a SHA-256 hash")
+		}
+		if lock.TimeoutHeight <= base.ChainLength {
+			return 0, errors.New("Hash time-lock has already timed out")
+		}
+		return 0, nil
+	}
+
+	if unlock := tx.Unlock; unlock != nil {
+		funds, ok := base.hashLock(unlock.LockID)
+		if !ok {
+			return 0, errors.New("No funds are locked by " + unlock.LockID)
+		}
+		if unlock.Preimage != "" {
+			if tx.From != funds.Recipient {
+				return 0, errors.New("Only the recipient may claim locked funds")
+			}
+			if base.ChainLength >= funds.TimeoutHeight {
+				return 0, errors.New("Hash time-lock has timed out")
+			}
+			if sha256hash(unlock.Preimage) != funds.Hash {
+				return 0, errors.New("Preimage does not match the hash time-lock")
+			}
+		} else {
+			if tx.From != funds.Sender {
+				return 0, errors.New("Only the sender may take back locked funds")
+			}
+			if base.ChainLength < funds.TimeoutHeight {
+				return 0, errors.New("Hash time-lock has not timed out yet")
+			}
+		}
+		return funds.Amount, nil
+	}
+	return 0, nil
+}
+
+/**
+ * Checks the hash time-lock parts of a transaction for the block that
+ * would follow this one, without building that block.
+ *
+ * @param {Transaction} tx - The transaction to check.
+ *
+ * @returns {error} - nil if the next block may include the transaction.
+ */
+func (base Block) checkHashLockAfter(tx Transaction) error {
+	// The ledger is only read, so the next block can share it.
+	next := base
+	next.ChainLength++
+	_, err := next.checkHashLock(tx)
+	return err
+}
+
+/**
+ * Looks up gold locked by a hash time-lock that has not been released yet.
+ *
+ * @param {String} lockID - The ID of the transaction that locked the gold.
+ *
+ * @returns {lockedFunds} - The locked gold, and false if there is no such lock.
+ */
+func (base Block) hashLock(lockID string) (lockedFunds, bool) {
+	if base.ledger == nil {
+		return lockedFunds{}, false
+	}
+	return base.ledger.lock(lockID)
+}
+
+/**
+ * Creates a random secret for a hash time-lock.
+ *
+ * @returns {String} - The preimage, and the hash to lock funds with.
+ */
+func newHashLockSecret() (string, string) {
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		fmt.Println(err)
+	}
+	preimage := hex.EncodeToString(secret)
+	return preimage, sha256hash(preimage)
+}
+
+/**
+ * Locks gold for a recipient until timeoutHeight.  The recipient can claim
+ * it with the preimage of hash, and otherwise the client can take it back
+ * with refundHashLock once the timeout has passed.
+ *
+ * @param {String} recipient - The address that may claim the gold.
+ * @param {Number} amount - The amount of gold to lock.
+ * @param {String} hash - The hex SHA-256 hash of the preimage.
+ * @param {Number} timeoutHeight - The first height at which the gold can no longer be claimed.
+ * @param {Number} fee - The transaction fee reward to pay the miner.
+ *
+ * @returns {Transaction} - The posted transaction, whose ID identifies the lock,
+ *    or an error if the recipient or lock is malformed.
+ */
+func (base *Client) lockHashLock(recipient string, amount int, hash string, timeoutHeight int, fee int) (Transaction, error) {
+	if err := validateAddress(recipient); err != nil {
+		return Transaction{}, err
+	}
+	base.fundMainAddress(amount, fee)
+	tx := base.newOutgoingTransaction(map[string]int{}, fee)
+	tx.Lock = &HashLock{recipient, amount, hash, timeoutHeight}
+	if err := base.lastBlock.checkHashLockAfter(*tx); err != nil {
+		// Giving back the nonce, since the transaction is never sent.
+		base.nonce--
+		return Transaction{}, err
+	}
+	return base.broadcastTransaction(tx), nil
+}
+
+/**
+ * Claims gold locked for the client by revealing the preimage.
+ *
+ * @param {String} lockID - The ID of the transaction that locked the gold.
+ * @param {String} preimage - The preimage of the lock's hash.
+ * @param {Number} fee - The transaction fee reward to pay the miner.
+ *
+ * @returns {Transaction} - The posted transaction.
+ */
+func (base *Client) claimHashLock(lockID string, preimage string, fee int) Transaction {
+	tx := base.newOutgoingTransaction(map[string]int{}, fee)
+	tx.Unlock = &HashUnlock{lockID, preimage}
+	return base.broadcastTransaction(tx)
+}
+
+/**
+ * Takes back gold the client locked, once the lock has timed out.
+ *
+ * @param {String} lockID - The ID of the transaction that locked the gold.
+ * @param {Number} fee - The transaction fee reward to pay the miner.
+ *
+ * @returns {Transaction} - The posted transaction.
+ */
+func (base *Client) refundHashLock(lockID string, fee int) Transaction {
+	tx := base.newOutgoingTransaction(map[string]int{}, fee)
+	tx.Unlock = &HashUnlock{LockID: lockID}
+	return base.broadcastTransaction(tx)
+}
+
+/**
+ * Searches the client's chain for a claim that revealed the preimage of
+ * a hash.  In an atomic swap, this is how the second party learns the
+ * secret after the first party claimed its side of the swap.
+ *
+ * @param {String} hash - The hex SHA-256 hash of the preimage.
+ *
+ * @returns {String} - The preimage, and false if no claim has revealed it.
+ */
+func (base *Client) findPreimage(hash string) (string, bool) {
+	for block := base.lastBlock; block.NotEmpty; {
+		for _, tx := range block.Transactions {
+			if tx.Unlock != nil && tx.Unlock.Preimage != "" && sha256hash(tx.Unlock.Preimage) == hash {
+				return tx.Unlock.Preimage, true
+			}
+		}
+		prevBlock, ok := base.getBlock(block.PrevBlockHash)
+		if !ok {
+			break
+		}
+		block = prevBlock
+	}
+	return "", false
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Version of the keystore file format.
+const KEYSTORE_VERSION int = 1
+
+// Parameters of the scrypt key derivation.  Each keystore stores its own
+// parameters, so they can be raised later without breaking old files.
+const KEYSTORE_SCRYPT_N int = 1 << 15
+const KEYSTORE_SCRYPT_R int = 8
+const KEYSTORE_SCRYPT_P int = 1
+const KEYSTORE_SALT_SIZE int = 32
+const KEYSTORE_KEY_SIZE int = 32
+
+// keystoreFile is the JSON form of an encrypted keypair.  The private key
+// is encrypted with AES-256-GCM under a key derived from the passphrase.
+// The address and scheme are authenticated along with it, so they cannot
+// be swapped out without the passphrase.
+type keystoreFile struct {
+	Version    int
+	Address    string
+	Scheme     string
+	ScryptN    int
+	ScryptR    int
+	ScryptP    int
+	Salt       []byte
+	Nonce      []byte
+	Ciphertext []byte
+}
+
+/**
+ * Encrypts a keypair with a passphrase and writes it to a keystore file.
+ *
+ * @param {String} path - The path of the keystore file.
+ * @param {keypair} kp - The keypair to save.
+ * @param {String} passphrase - The passphrase protecting the file.
+ */
+func saveKeystore(path string, kp keypair, passphrase string) error {
+	var privKey interface{}
+	scheme := SIG_SCHEME_RSA
+	switch signer := kp.signer.(type) {
+	case nil:
+		privKey = kp.privKey
+	case ed25519Signer:
+		privKey = signer.privKey
+		scheme = signer.scheme()
+	case ecdsaP256Signer:
+		privKey = signer.privKey
+		scheme = signer.scheme()
+	default:
+		return errors.New("Keystores cannot hold keys of scheme " + signer.scheme())
+	}
+	plaintext, err := x509.MarshalPKCS8PrivateKey(privKey)
+	if err != nil {
+		return err
+	}
+
+	ks := keystoreFile{
+		Version: KEYSTORE_VERSION,
+		Address: kp.address(),
+		Scheme:  scheme,
+		ScryptN: KEYSTORE_SCRYPT_N,
+		ScryptR: KEYSTORE_SCRYPT_R,
+		ScryptP: KEYSTORE_SCRYPT_P,
+		Salt:    make([]byte, KEYSTORE_SALT_SIZE),
+	}
+	if _, err := rand.Read(ks.Salt); err != nil {
+		return err
+	}
+	aead, err := ks.cipher(passphrase)
+	if err != nil {
+		return err
+	}
+	ks.Nonce = make([]byte, aead.NonceSize())
+	if _, err := rand.Read(ks.Nonce); err != nil {
+		return err
+	}
+	ks.Ciphertext = aead.Seal(nil, ks.Nonce, plaintext, ks.additionalData())
+
+	data, err := json.MarshalIndent(ks, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	// Writing to a temporary file first, so a key is never half written.
+	if err := ioutil.WriteFile(path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+/**
+ * Reads a keystore file and decrypts its keypair.
+ *
+ * @param {String} path - The path of the keystore file.
+ * @param {String} passphrase - The passphrase protecting the file.
+ *
+ * @returns {keypair} - The keypair, or an error for a wrong passphrase or a damaged file.
+ */
+func loadKeystore(path string, passphrase string) (keypair, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return keypair{}, err
+	}
+	var ks keystoreFile
+	if err := json.Unmarshal(data, &ks); err != nil {
+		return keypair{}, err
+	}
+	if ks.Version != KEYSTORE_VERSION {
+		return keypair{}, errors.New("Unknown keystore version")
+	}
+	aead, err := ks.cipher(passphrase)
+	if err != nil {
+		return keypair{}, err
+	}
+	if len(ks.Nonce) != aead.NonceSize() {
+		return keypair{}, errors.New("Keystore is damaged")
+	}
+	plaintext, err := aead.Open(nil, ks.Nonce, ks.Ciphertext, ks.additionalData())
+	if err != nil {
+		return keypair{}, errors.New("Wrong passphrase, or the keystore is damaged")
+	}
+	privKey, err := x509.ParsePKCS8PrivateKey(plaintext)
+	if err != nil {
+		return keypair{}, err
+	}
+
+	var kp keypair
+	switch key := privKey.(type) {
+	case *rsa.PrivateKey:
+		kp = keypair{pubKey: key.PublicKey, privKey: key}
+	case ed25519.PrivateKey:
+		kp = keypair{signer: ed25519Signer{key}}
+	case *ecdsa.PrivateKey:
+		kp = keypair{signer: ecdsaP256Signer{key}}
+	default:
+		return keypair{}, errors.New("Keystore holds an unsupported key")
+	}
+	if kp.address() != ks.Address {
+		return keypair{}, errors.New("Keystore key does not match its address")
+	}
+	return kp, nil
+}
+
+/**
+ * Loads the keypair of a keystore file, or creates the file with a new
+ * keypair if it does not exist yet.  An existing file keeps the scheme
+ * of its key.
+ *
+ * @param {String} path - The path of the keystore file.
+ * @param {String} passphrase - The passphrase protecting the file.
+ * @param {String} scheme - The signature scheme of a new keypair.
+ *
+ * @returns {keypair} - The keypair.
+ */
+func openKeystore(path string, passphrase string, scheme string) (keypair, error) {
+	kp, err := loadKeystore(path, passphrase)
+	if !os.IsNotExist(err) {
+		return kp, err
+	}
+	kp, err = generateSchemeKeypair(scheme)
+	if err != nil {
+		return keypair{}, err
+	}
+	if err := saveKeystore(path, kp, passphrase); err != nil {
+		return keypair{}, err
+	}
+	return kp, nil
+}
+
+// Derives the encryption key from the passphrase and builds the cipher.
+func (base keystoreFile) cipher(passphrase string) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), base.Salt, base.ScryptN, base.ScryptR, base.ScryptP, KEYSTORE_KEY_SIZE)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (base keystoreFile) additionalData() []byte {
+	enc := new(txEncoder)
+	enc.writeInt(int64(base.Version))
+	enc.writeString(base.Address)
+	enc.writeString(base.Scheme)
+	return enc.buf.Bytes()
+}
+
+/**
+ * Creates a client whose keypair is kept in a keystore file, so that the
+ * client keeps its address across runs.  The file is created if needed.
+ *
+ * @param {String} name - The client's name, used for debugging messages.
+ * @param {String} keystorePath - The path of the keystore file.
+ * @param {String} passphrase - The passphrase protecting the keystore.
+ * @param {String} scheme - The signature scheme of a new keypair.
+ * @param {Block} startingBlock - The genesis block, or an empty block.
+ * @param {FakeNet} fakeNet - The network the client uses.
+ */
+func newClientWithKeystore(name string, keystorePath string, passphrase string, scheme string, startingBlock Block, fakeNet *FakeNet) (*Client, error) {
+	kp, err := openKeystore(keystorePath, passphrase, scheme)
+	if err != nil {
+		return nil, err
+	}
+	return newClient(name, kp, startingBlock, fakeNet), nil
+}
+
+/**
+ * Creates a miner whose keypair is kept in a keystore file.
+ *
+ * @param {String} name - The miner's name, used for debugging messages.
+ * @param {String} keystorePath - The path of the keystore file.
+ * @param {String} passphrase - The passphrase protecting the keystore.
+ * @param {String} scheme - The signature scheme of a new keypair.
+ * @param {Block} startingBlock - The genesis block, or an empty block.
+ * @param {FakeNet} fakeNet - The network the miner uses.
+ */
+func newMinerWithKeystore(name string, keystorePath string, passphrase string, scheme string, startingBlock Block, fakeNet *FakeNet) (*Miner, error) {
+	kp, err := openKeystore(keystorePath, passphrase, scheme)
+	if err != nil {
+		return nil, err
+	}
+	return newMiner(name, kp, startingBlock, fakeNet), nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import "strconv"
+
+// ledgerState holds the balances and nonces of every account as seen by one
+// block.  The accounts are kept in persistent maps, so a child state shares
+// everything with its parent and each change only copies the path to the
+// changed entry.  Memory therefore grows with the number of changes, not
+// with accounts times blocks.  A state is frozen once a child has been made
+// from it, so a block can never change the balances seen by its ancestors.
+type ledgerState struct {
+	balances pmap
+	nonces   pmap
+	// Unspent outputs, keyed by utxoKey.
+	utxos pmap
+	// Funds held by hash time-locks, keyed by the ID of the locking transaction.
+	locks  pmap
+	frozen bool
+}
+
+// An unspent output as stored in the ledger, along with its outpoint.
+type utxoEntry struct {
+	op  OutPoint
+	out TxOutput
+}
+
+func newLedgerState() *ledgerState {
+	return new(ledgerState)
+}
+
+func utxoKey(op OutPoint) string {
+	return op.TxID + ":" + strconv.Itoa(op.Index)
+}
+
+/**
+ * Makes a new state that starts out sharing all of this state's entries,
+ * and freezes this state.
+ *
+ * @returns {ledgerState} - A state that starts with the same balances and nonces.
+ */
+func (base *ledgerState) child() *ledgerState {
+	base.frozen = true
+	state := *base
+	state.frozen = false
+	return &state
+}
+
+func (base *ledgerState) balanceOf(addr string) int {
+	if balance, ok := base.balances.get(addr); ok {
+		return balance.(int)
+	}
+	return 0
+}
+
+func (base *ledgerState) nextNonce(addr string) int {
+	if nonce, ok := base.nonces.get(addr); ok {
+		return nonce.(int)
+	}
+	return 0
+}
+
+func (base *ledgerState) setBalance(addr string, balance int) {
+	base.checkWritable()
+	base.balances = base.balances.set(addr, balance)
+}
+
+func (base *ledgerState) setNextNonce(addr string, nonce int) {
+	base.checkWritable()
+	base.nonces = base.nonces.set(addr, nonce)
+}
+
+/**
+ * Looks up an unspent output.
+ *
+ * @param {OutPoint} op - The output to look up.
+ *
+ * @returns {TxOutput} - The output, and false if it does not exist or was spent.
+ */
+func (base *ledgerState) utxo(op OutPoint) (TxOutput, bool) {
+	if entry, ok := base.utxos.get(utxoKey(op)); ok {
+		return entry.(utxoEntry).out, true
+	}
+	return TxOutput{}, false
+}
+
+func (base *ledgerState) addUTXO(op OutPoint, out TxOutput) {
+	base.checkWritable()
+	base.utxos = base.utxos.set(utxoKey(op), utxoEntry{op, out})
+}
+
+func (base *ledgerState) spendUTXO(op OutPoint) {
+	base.checkWritable()
+	base.utxos = base.utxos.delete(utxoKey(op))
+}
+
+/**
+ * Looks up funds held by a hash time-lock.
+ *
+ * @param {String} lockID - The ID of the transaction that locked the funds.
+ *
+ * @returns {lockedFunds} - The locked funds, and false if there is no such lock or it was released.
+ */
+func (base *ledgerState) lock(lockID string) (lockedFunds, bool) {
+	if funds, ok := base.locks.get(lockID); ok {
+		return funds.(lockedFunds), true
+	}
+	return lockedFunds{}, false
+}
+
+func (base *ledgerState) addLock(lockID string, funds lockedFunds) {
+	base.checkWritable()
+	base.locks = base.locks.set(lockID, funds)
+}
+
+func (base *ledgerState) releaseLock(lockID string) {
+	base.checkWritable()
+	base.locks = base.locks.delete(lockID)
+}
+
+func (base *ledgerState) checkWritable() {
+	if base.frozen {
+		panic("ledger state of a block with children cannot be changed")
+	}
+}
+
+/**
+ * Returns the balance of every account, copied into a new map.
+ */
+func (base *ledgerState) allBalances() map[string]int {
+	balances := make(map[string]int, base.balances.size)
+	base.balances.each(func(addr string, balance interface{}) {
+		balances[addr] = balance.(int)
+	})
+	return balances
+}
+
+/**
+ * Returns every unspent output, copied into a new map.
+ */
+func (base *ledgerState) allUTXOs() map[OutPoint]TxOutput {
+	utxos := make(map[OutPoint]TxOutput, base.utxos.size)
+	base.utxos.each(func(key string, entry interface{}) {
+		utxos[entry.(utxoEntry).op] = entry.(utxoEntry).out
+	})
+	return utxos
+}
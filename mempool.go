@@ -0,0 +1,297 @@
+package main
+
+import (
+	"errors"
+	"sort"
+)
+
+// Limits for the transactions a miner keeps.  A transaction may be at most
+// MAX_QUEUED_PER_SENDER nonces ahead of the sender's next nonce, and the
+// pool holds at most MAX_QUEUED_TRANSACTIONS transactions.
+const MAX_QUEUED_PER_SENDER int = 16
+const MAX_QUEUED_TRANSACTIONS int = 1024
+
+// Constants for block assembly.  Blocks hold at most MAX_BLOCK_SIZE bytes of
+// transactions, and miners by default relay no transaction paying less than
+// MIN_RELAY_FEE_PER_KB gold per 1000 bytes.
+const MAX_BLOCK_SIZE int = 50000
+const MIN_RELAY_FEE_PER_KB int = 1
+
+// txPool holds every transaction a miner knows of that the chain has not
+// accepted yet, including transactions waiting for an earlier nonce.
+// At most one transaction per sender and nonce, or per spent output in
+// UTXO mode, is kept; a conflicting transaction must replace it.
+type txPool struct {
+	txs     map[string]Transaction
+	byNonce map[string]map[int]string
+	spentBy map[OutPoint]string
+}
+
+func newTxPool() *txPool {
+	pool := new(txPool)
+	pool.txs = make(map[string]Transaction)
+	pool.byNonce = make(map[string]map[int]string)
+	pool.spentBy = make(map[OutPoint]string)
+	return pool
+}
+
+/**
+ * The size of a transaction, used to compare fees and to fill blocks.
+ *
+ * @returns {Number} - The size in bytes of the signed transaction.
+ */
+func (base Transaction) size() int {
+	payload, _ := base.canonicalEncoding()
+	size := len(payload) + len(base.Sig)
+	for _, sig := range base.Sigs {
+		size += len(sig.Sig)
+	}
+	return size
+}
+
+/**
+ * Compares the fee paid per byte of two transactions.  Ties are broken by
+ * the lower transaction ID, so every miner orders transactions the same way.
+ *
+ * @param {Transaction} other - The transaction to compare with.
+ *
+ * @returns {Boolean} - True if this transaction should be picked first.
+ */
+func (base Transaction) hasHigherFeeRate(other Transaction) bool {
+	lhs := base.Fee * other.size()
+	rhs := other.Fee * base.size()
+	if lhs != rhs {
+		return lhs > rhs
+	}
+	return base.Id < other.Id
+}
+
+/**
+ * Adds a transaction to the pool.  A transaction that conflicts with a
+ * pooled one is ignored; see replace.
+ *
+ * @param {Transaction} tx - The transaction to add.
+ *
+ * @returns {Boolean} - True if the transaction was added.
+ */
+func (base *txPool) add(tx Transaction) bool {
+	if _, dupped := base.txs[tx.Id]; dupped || len(base.txs) >= MAX_QUEUED_TRANSACTIONS {
+		return false
+	}
+	if len(base.conflicts(tx)) > 0 {
+		return false
+	}
+	if tx.IO == nil {
+		nonces, ok := base.byNonce[tx.From]
+		if !ok {
+			nonces = make(map[int]string)
+			base.byNonce[tx.From] = nonces
+		}
+		nonces[tx.Nonce] = tx.Id
+	} else {
+		for _, input := range tx.IO.Inputs {
+			base.spentBy[input] = tx.Id
+		}
+	}
+	base.txs[tx.Id] = tx
+	return true
+}
+
+/**
+ * Returns the pooled transactions that cannot both be included with the
+ * given transaction: in account mode the one with the same sender and
+ * nonce, and in UTXO mode any that spend one of the same outputs.
+ *
+ * @param {Transaction} tx - The new transaction.
+ *
+ * @returns {Array} - The conflicting transactions.
+ */
+func (base *txPool) conflicts(tx Transaction) []Transaction {
+	var conflicts []Transaction
+	if tx.IO == nil {
+		if pooled, ok := base.get(tx.From, tx.Nonce); ok {
+			conflicts = append(conflicts, pooled)
+		}
+		return conflicts
+	}
+	seen := make(map[string]bool)
+	for _, input := range tx.IO.Inputs {
+		if id, ok := base.spentBy[input]; ok && !seen[id] {
+			seen[id] = true
+			conflicts = append(conflicts, base.txs[id])
+		}
+	}
+	return conflicts
+}
+
+/**
+ * Replaces the transactions conflicting with the given one.  The
+ * replacement must pay a higher fee rate than each transaction it replaces,
+ * and its fee must cover their fees plus the minimum relay fee for its own
+ * size, so that replacements cannot be relayed over and over for free.
+ *
+ * @param {Transaction} tx - The replacement transaction.
+ * @param {Number} minRelayFee - The minimum fee in gold per 1000 bytes.
+ *
+ * @returns {Array} - The replaced transactions, and an error if the rules are not met.
+ */
+func (base *txPool) replace(tx Transaction, minRelayFee int) ([]Transaction, error) {
+	conflicts := base.conflicts(tx)
+	if len(conflicts) == 0 {
+		return nil, errors.New("Transaction does not replace any pooled transaction")
+	}
+	replacedFees := 0
+	for _, old := range conflicts {
+		if tx.Fee*old.size() <= old.Fee*tx.size() {
+			return nil, errors.New("Replacement does not pay a higher fee rate")
+		}
+		replacedFees += old.Fee
+	}
+	if (tx.Fee-replacedFees)*1000 < minRelayFee*tx.size() {
+		return nil, errors.New("Replacement does not pay enough to cover its relay")
+	}
+	for _, old := range conflicts {
+		base.remove(old)
+	}
+	if !base.add(tx) {
+		for _, old := range conflicts {
+			base.add(old)
+		}
+		return nil, errors.New("Replacement could not be added to the pool")
+	}
+	return conflicts, nil
+}
+
+/**
+ * Returns the pooled transaction of a sender with the given nonce.
+ *
+ * @param {String} sender - The address of the sender.
+ * @param {Number} nonce - The nonce of the transaction.
+ */
+func (base *txPool) get(sender string, nonce int) (Transaction, bool) {
+	id, ok := base.byNonce[sender][nonce]
+	if !ok {
+		return Transaction{}, false
+	}
+	return base.txs[id], true
+}
+
+func (base *txPool) remove(tx Transaction) {
+	delete(base.txs, tx.Id)
+	if tx.IO == nil && base.byNonce[tx.From][tx.Nonce] == tx.Id {
+		delete(base.byNonce[tx.From], tx.Nonce)
+		if len(base.byNonce[tx.From]) == 0 {
+			delete(base.byNonce, tx.From)
+		}
+	}
+	if tx.IO != nil {
+		for _, input := range tx.IO.Inputs {
+			if base.spentBy[input] == tx.Id {
+				delete(base.spentBy, input)
+			}
+		}
+	}
+}
+
+/**
+ * Drops every transaction that can no longer be added after the given
+ * block, because it was included, conflicts with an included transaction,
+ * has expired, or has a hash time-lock part that is no longer valid.
+ *
+ * @param {Block} block - The tip of the chain.
+ */
+func (base *txPool) prune(block Block) {
+	for _, tx := range base.txs {
+		if block.settles(tx) || tx.expiredAt(block.ChainLength+1) || block.checkHashLockAfter(tx) != nil {
+			base.remove(tx)
+		}
+	}
+}
+
+/**
+ * Returns the senders that have pooled account-mode transactions, in a fixed order.
+ */
+func (base *txPool) senders() []string {
+	senders := make([]string, 0, len(base.byNonce))
+	for sender := range base.byNonce {
+		senders = append(senders, sender)
+	}
+	sort.Strings(senders)
+	return senders
+}
+
+/**
+ * Returns the pooled transactions, highest fee rate first.
+ */
+func (base *txPool) byFeeRate() []Transaction {
+	txs := make([]Transaction, 0, len(base.txs))
+	for _, tx := range base.txs {
+		txs = append(txs, tx)
+	}
+	sort.Slice(txs, func(i, j int) bool {
+		return txs[i].hasHigherFeeRate(txs[j])
+	})
+	return txs
+}
+
+/**
+ * Fills a block from the pool, highest fee rate first, until no more
+ * transactions fit in MAX_BLOCK_SIZE.  In account mode, a sender's
+ * transactions are only considered in nonce order, so a transaction
+ * competes on its own fee rate once every earlier nonce has been picked.
+ *
+ * @param {Block} block - The new block, which must not hold transactions yet.
+ */
+func (base *txPool) fillBlock(block *Block) {
+	size := 0
+	fits := func(tx Transaction) bool {
+		if !tx.validAt(block.ChainLength) || size+tx.size() > MAX_BLOCK_SIZE || !block.addTransaction(tx) {
+			return false
+		}
+		size += tx.size()
+		return true
+	}
+
+	if block.config().utxoMode {
+		// A transaction may spend outputs of another pooled transaction,
+		// so keep going over the pool while transactions are still added.
+		remaining := base.byFeeRate()
+		for added := true; added; {
+			added = false
+			var skipped []Transaction
+			for _, tx := range remaining {
+				if fits(tx) {
+					added = true
+				} else {
+					skipped = append(skipped, tx)
+				}
+			}
+			remaining = skipped
+		}
+		return
+	}
+
+	heads := make(map[string]Transaction)
+	for _, sender := range base.senders() {
+		if tx, ok := base.get(sender, block.nextNonce(sender)); ok {
+			heads[sender] = tx
+		}
+	}
+	for len(heads) > 0 {
+		var best Transaction
+		found := false
+		for _, tx := range heads {
+			if !found || tx.hasHigherFeeRate(best) {
+				best = tx
+				found = true
+			}
+		}
+		delete(heads, best.From)
+		if !fits(best) {
+			continue
+		}
+		if next, ok := base.get(best.From, block.nextNonce(best.From)); ok {
+			heads[best.From] = next
+		}
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+)
+
+// Prefixes that keep leaf hashes and interior node hashes apart, so that
+// an interior node can never be passed off as a transaction ID.
+const MERKLE_LEAF_PREFIX = "\x00"
+const MERKLE_NODE_PREFIX = "\x01"
+
+// MerkleStep is one sibling hash on the path from a leaf to the root.
+type MerkleStep struct {
+	Hash string
+	// True if the sibling is the left child.
+	Left bool
+}
+
+// MerkleProof shows that a transaction is included in a block,
+// given only the transaction root from the block header.
+type MerkleProof struct {
+	TxID  string
+	Steps []MerkleStep
+}
+
+func merkleLeaf(id string) string {
+	return sha256hash(MERKLE_LEAF_PREFIX + id)
+}
+
+func merkleNode(left string, right string) string {
+	return sha256hash(MERKLE_NODE_PREFIX + left + right)
+}
+
+/**
+ * Builds every level of the Merkle tree, starting from the leaves.
+ * When a level has an odd number of nodes, the last node is moved up
+ * unchanged rather than being paired with a copy of itself.
+ *
+ * @param {Array} ids - The transaction IDs in canonical order.
+ *
+ * @returns {Array} - The levels of the tree; the last level holds the root.
+ */
+func merkleLevels(ids []string) [][]string {
+	level := make([]string, len(ids))
+	for i, id := range ids {
+		level[i] = merkleLeaf(id)
+	}
+	levels := [][]string{level}
+	for len(level) > 1 {
+		var next []string
+		for i := 0; i < len(level); i += 2 {
+			if i+1 < len(level) {
+				next = append(next, merkleNode(level[i], level[i+1]))
+			} else {
+				next = append(next, level[i])
+			}
+		}
+		levels = append(levels, next)
+		level = next
+	}
+	return levels
+}
+
+/**
+ * Calculates the Merkle root of a list of transaction IDs.
+ *
+ * @param {Array} ids - The transaction IDs in canonical order.
+ *
+ * @returns {String} - The root hash.  A block without transactions
+ *    has the hash of the empty string as its root.
+ */
+func merkleRoot(ids []string) string {
+	if len(ids) == 0 {
+		return sha256hash("")
+	}
+	levels := merkleLevels(ids)
+	return levels[len(levels)-1][0]
+}
+
+/**
+ * Collects the sibling hashes needed to get from a leaf to the root.
+ *
+ * @param {Array} ids - The transaction IDs in canonical order.
+ * @param {Number} index - The position of the transaction to prove.
+ *
+ * @returns {MerkleProof} - The inclusion proof for the transaction.
+ */
+func merkleProof(ids []string, index int) MerkleProof {
+	proof := MerkleProof{TxID: ids[index]}
+	levels := merkleLevels(ids)
+	for _, level := range levels[:len(levels)-1] {
+		if index%2 == 1 {
+			proof.Steps = append(proof.Steps, MerkleStep{level[index-1], true})
+		} else if index+1 < len(level) {
+			proof.Steps = append(proof.Steps, MerkleStep{level[index+1], false})
+		}
+		index /= 2
+	}
+	return proof
+}
+
+/**
+ * Checks an inclusion proof against a transaction root.
+ *
+ * @param {String} root - The transaction root from a block header.
+ * @param {MerkleProof} proof - The proof to check.
+ *
+ * @returns {Boolean} - True if the proof shows the transaction is under the root.
+ */
+func verifyMerkleProof(root string, proof MerkleProof) bool {
+	h := merkleLeaf(proof.TxID)
+	for _, step := range proof.Steps {
+		if step.Left {
+			h = merkleNode(step.Hash, h)
+		} else {
+			h = merkleNode(h, step.Hash)
+		}
+	}
+	return h == root
+}
+
+/**
+ * Returns a proof that a transaction is included in this block.
+ * The proof can be checked with verifyMerkleProof against the TxRoot
+ * of the block header, without the rest of the block.
+ *
+ * @param {String} txID - The ID of the transaction.
+ *
+ * @returns {MerkleProof} - The inclusion proof, or an error if the
+ *    transaction is not in the block.
+ */
+func (base Block) getInclusionProof(txID string) (MerkleProof, error) {
+	ids := base.sortedTxIDs()
+	for i, id := range ids {
+		if id == txID {
+			return merkleProof(ids, i), nil
+		}
+	}
+	return MerkleProof{}, errors.New("Transaction is not in the block")
+}
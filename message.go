@@ -0,0 +1,113 @@
+package main
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+)
+
+// Domain tag of signed messages.  A message signature covers a hash of the
+// tag and the message, which can never equal the ID of a transaction, since
+// transaction IDs hash bytes that start with TX_DOMAIN_TAG instead.
+const MESSAGE_DOMAIN_TAG = "DRAGONCOIN/MSG/v1"
+
+// MessageSignature proves that the holder of an address signed a message.
+// It carries the public key, since an address is only a hash of the key.
+// Like in transactions, PubKey is unused when a scheme is named.
+type MessageSignature struct {
+	PubKey    rsa.PublicKey
+	Scheme    string `json:",omitempty"`
+	SchemeKey []byte `json:",omitempty"`
+	Sig       []byte
+}
+
+/**
+ * Returns the digest that is signed for a message.
+ *
+ * @param {String} message - The message text.
+ *
+ * @returns {String} - The hex-encoded hash of the domain tag and the message.
+ */
+func messageDigest(message string) string {
+	enc := new(txEncoder)
+	enc.writeString(MESSAGE_DOMAIN_TAG)
+	enc.writeString(message)
+	return sha256hash(enc.buf.String())
+}
+
+/**
+ * Signs a message with the keypair.
+ *
+ * @param {String} message - The message text.
+ *
+ * @returns {String} - The base64-encoded signature.
+ */
+func (base keypair) signMessage(message string) string {
+	var msgSig MessageSignature
+	digest := messageDigest(message)
+	if base.signer == nil {
+		msgSig.PubKey = base.pubKey
+		msgSig.Sig = sign(base.privKey, digest)
+	} else {
+		msgSig.Scheme = base.signer.scheme()
+		msgSig.SchemeKey = base.signer.publicKey()
+		msgSig.Sig = base.signer.sign(digest)
+	}
+	data, _ := json.Marshal(msgSig)
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+/**
+ * Signs a message to prove that the client controls one of its addresses.
+ *
+ * @param {String} addr - The address to sign with.
+ * @param {String} message - The message text.
+ *
+ * @returns {String} - The base64-encoded signature, or an error if the address is not the client's.
+ */
+func (base Client) signMessage(addr string, message string) (string, error) {
+	if !base.ownsAddress(addr) {
+		return "", errors.New("Address does not belong to " + base.name)
+	}
+	return base.keyFor(addr).signMessage(message), nil
+}
+
+/**
+ * Verifies that a message was signed by the key of an address.
+ *
+ * @param {String} addr - The address that claims to have signed.
+ * @param {String} message - The message text.
+ * @param {String} signature - The base64-encoded signature.
+ *
+ * @returns {error} - nil if the signature is valid.
+ */
+func verifyMessage(addr string, message string, signature string) error {
+	data, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return errors.New("Signature is not valid base64")
+	}
+	var msgSig MessageSignature
+	if err := json.Unmarshal(data, &msgSig); err != nil {
+		return errors.New("Signature could not be decoded")
+	}
+	if len(msgSig.Sig) == 0 {
+		return errors.New("Signature is empty")
+	}
+	digest := messageDigest(message)
+
+	if msgSig.Scheme == "" {
+		if msgSig.PubKey.N == nil || !addressMatchesKey(addr, &msgSig.PubKey) {
+			return errors.New("Signing key does not match the address")
+		}
+		return verifySignature(&msgSig.PubKey, digest, msgSig.Sig)
+	}
+	s, ok := signatureSchemes[msgSig.Scheme]
+	if !ok {
+		return errors.New("Unknown signature scheme " + msgSig.Scheme)
+	}
+	if addr != calcSchemeAddress(msgSig.Scheme, msgSig.SchemeKey) {
+		return errors.New("Signing key does not match the address")
+	}
+	return s.verify(msgSig.SchemeKey, digest, msgSig.Sig)
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"encoding/json"
 	"errors"
 	"fmt"
 	"reflect"
@@ -13,6 +12,10 @@ type Miner struct {
 	keypairMiner  keypair
 	miningRounds  int
 	currentBlock  *Block
+	// Transactions not yet accepted by the chain, from which blocks are assembled.
+	pool *txPool
+	// Transactions paying less than this many gold per 1000 bytes are not relayed.
+	minRelayFee int
 }
 
 /**
@@ -34,6 +37,8 @@ func newMiner(name string, keypairMiner keypair, startingBlock Block, fakeNet *F
 	miner := new(Miner)
 	miner.Client = newClient(name, keypairMiner, startingBlock, fakeNet)
 	miner.miningRounds = NUM_ROUNDS_MINING
+	miner.pool = newTxPool()
+	miner.minRelayFee = MIN_RELAY_FEE_PER_KB
 
 	return miner
 }
@@ -41,7 +46,7 @@ func newMiner(name string, keypairMiner keypair, startingBlock Block, fakeNet *F
 /**
  * Starts listeners and begins mining.
  */
-func (base Miner) initialize() {
+func (base *Miner) initialize() {
 	var set []Transaction
 	base.startNewSearch(set)
 
@@ -49,6 +54,7 @@ func (base Miner) initialize() {
 	base.emitter.On(POST_TRANSACTION, base.addTransaction)
 	base.Client.emitter.Off(PROOF_FOUND, base.Client.receiveBlock)
 	base.emitter.On(PROOF_FOUND, base.receiveBlock)
+	base.emitter.On(CHAIN_REORG, base.cutOver)
 
 	base.emitStartMining()
 }
@@ -65,12 +71,38 @@ func (base Miner) emitStartMining() {
  * @param {Set} [txSet] - Transactions the miner has that have not been accepted yet.
  */
 func (base *Miner) startNewSearch(set []Transaction) {
-	base.currentBlock = base.Client.lastBlock.makeBlock(base.Client.address)
 	for _, tx := range set {
-		base.addTransaction(tx)
+		base.admitTransaction(tx)
 	}
+	base.pool.prune(base.Client.lastBlock)
+	base.assembleBlock()
+}
+
+/**
+ * Builds a new current block on top of the last block, picking the
+ * transactions from the pool that pay the most fees.
+ */
+func (base *Miner) assembleBlock() {
+	block := base.Client.lastBlock.makeBlock(base.Client.address, base.Client.getBlock)
+	block.Timestamp = base.nextTimestamp()
+	base.pool.fillBlock(block)
+	block.Proof = 0
+	base.currentBlock = block
+}
 
-	base.currentBlock.Proof = 0
+/**
+ * Returns the timestamp for a new block, which is the current time unless
+ * that would be older than the median of the recent blocks.
+ *
+ * @returns {Number} - The timestamp in milliseconds.
+ */
+func (base *Miner) nextTimestamp() int64 {
+	timestamp := base.Client.now()
+	median := base.Client.lastBlock.medianTimePast(base.Client.getBlock)
+	if timestamp < median {
+		timestamp = median
+	}
+	return timestamp
 }
 
 /**
@@ -100,93 +132,144 @@ func (base *Miner) findProof() {
 }
 
 /**
- * Returns false if transaction is not accepted. Otherwise adds
- * the transaction to the current block.
+ * Returns false if transaction is not accepted. Otherwise adds the
+ * transaction to the pool and rebuilds the current block, which includes
+ * the transaction if its fee rate earns it a place.  A transaction whose
+ * nonce is ahead of the sender's next nonce stays in the pool until the
+ * transactions before it have arrived.
  *
  * @param {Transaction | String} tx - The transaction to add.
  */
-func (base Miner) addTransaction(tx Transaction) bool {
-	return base.currentBlock.addTransaction(tx)
+func (base *Miner) addTransaction(tx Transaction) bool {
+	if !base.admitTransaction(tx) {
+		return false
+	}
+	base.assembleBlock()
+	return true
+}
+
+/**
+ * Checks a transaction against the relay rules and adds it to the pool.
+ *
+ * @param {Transaction} tx - The transaction to add.
+ *
+ * @returns {Boolean} - True if the transaction was added to the pool.
+ */
+func (base *Miner) admitTransaction(tx Transaction) bool {
+	if !validSignatureTransaction(tx) {
+		fmt.Printf("Invalid signature for transaction %v.\n", tx.Id)
+		return false
+	}
+	if tx.Fee < 0 {
+		fmt.Printf("Negative fee in transaction %v.\n", tx.Id)
+		return false
+	}
+	if tx.Fee*1000 < base.minRelayFee*tx.size() {
+		fmt.Printf("Fee of transaction %v is below the minimum relay fee.\n", tx.Id)
+		return false
+	}
+	if base.Client.lastBlock.settles(tx) {
+		fmt.Printf("Replayed transaction %v.\n", tx.Id)
+		return false
+	}
+	if tx.expiredAt(base.Client.lastBlock.ChainLength + 1) {
+		fmt.Printf("Expired transaction %v.\n", tx.Id)
+		return false
+	}
+	if err := base.Client.lastBlock.checkHashLockAfter(tx); err != nil {
+		fmt.Printf("Invalid hash time-lock in transaction %v: %v.\n", tx.Id, err)
+		return false
+	}
+	if tx.IO == nil && tx.Nonce-base.Client.lastBlock.nextNonce(tx.From) >= MAX_QUEUED_PER_SENDER {
+		fmt.Printf("Nonce of transaction %v is too far ahead.\n", tx.Id)
+		return false
+	}
+	if _, pooled := base.pool.txs[tx.Id]; pooled {
+		return false
+	}
+	if len(base.pool.conflicts(tx)) > 0 {
+		replaced, err := base.pool.replace(tx, base.minRelayFee)
+		if err != nil {
+			fmt.Printf("Rejected replacement %v: %v\n", tx.Id, err)
+			return false
+		}
+		for _, old := range replaced {
+			fmt.Printf("%v: Transaction %v replaced by %v.\n", base.Client.name, old.Id, tx.Id)
+		}
+		return true
+	}
+	return base.pool.add(tx)
 }
 
 /**
  * Broadcast the block, with a valid proof included.
  */
 func (base Miner) announceProof() {
-	blockJSON, _ := json.Marshal(*base.currentBlock)
-	base.Client.fakeNet.broadcast(PROOF_FOUND, blockJSON)
+	base.Client.fakeNet.broadcast(PROOF_FOUND, []byte(base.currentBlock.serialize()))
 }
 
 /**
  * Receives a block from another miner. If it is valid,
- * the block will be stored. If it is also a longer chain,
- * the miner will accept it and replace the currentBlock.
+ * the block will be stored. If it is also the tip of the chain
+ * with the most work, the client emits a CHAIN_REORG event and
+ * the miner replaces the currentBlock in cutOver.
  *
  * @param {Block | Object} b - The block
  */
 func (base *Miner) receiveBlock(block Block) error {
-	b, err := base.Client.receiveBlock(block)
+	_, err := base.Client.receiveBlock(block)
 
 	if err != nil {
 		fmt.Printf("%v encountered error %v\n", base.Client.name, err)
 		return errors.New("Invalid block")
-	} else if base.currentBlock.NotEmpty && b.ChainLength >= base.currentBlock.ChainLength {
-		fmt.Printf("%v: Cutting over to new chain length %v from current length %v\n", base.Client.name, b.ChainLength, base.currentBlock.ChainLength)
-		txSet := base.syncTransactions(b)
-		base.startNewSearch(txSet)
-	} else {
-		fmt.Printf("New Chain Rejected because current chain is empty: %v, or current chain %v > new chain %v, or we announced this block\n", !base.currentBlock.NotEmpty, base.currentBlock.ChainLength, b.ChainLength)
 	}
-
 	return nil
 }
 
 /**
- * This function should determine what transactions
- * need to be added or deleted.  It should find a common ancestor (retrieving
- * any transactions from the rolled-back blocks), remove any transactions
- * already included in the newly accepted blocks, and add any remaining
- * transactions to the new block.
+ * Starts mining on top of the new best chain, keeping every transaction
+ * that the new chain has not accepted yet.
+ *
+ * @param {ChainReorg} reorg - The change of the best chain.
+ */
+func (base *Miner) cutOver(reorg ChainReorg) {
+	if !base.currentBlock.NotEmpty {
+		return
+	}
+	fmt.Printf("%v: Cutting over to new chain length %v with total work %v\n", base.Client.name, reorg.NewTip.ChainLength, reorg.NewTip.TotalWork)
+	txSet := base.syncTransactions(reorg)
+	base.startNewSearch(txSet)
+}
+
+/**
+ * This function determines what transactions need to be added or deleted.
+ * It takes the transactions of the current block and of the rolled-back
+ * blocks, and removes any transactions already included in the newly
+ * accepted blocks.
  *
- * @param {Block} nb - The newly accepted block.
+ * @param {ChainReorg} reorg - The blocks leaving and joining the best chain.
  *
- * @returns {Set} - The set of transactions that have not yet been accepted by the new block.
+ * @returns {Set} - The set of transactions that have not yet been accepted by the new chain.
  */
-func (base Miner) syncTransactions(nb Block) []Transaction {
-	cb := *base.currentBlock
+func (base Miner) syncTransactions(reorg ChainReorg) []Transaction {
 	var cbTxs []Transaction
-	var nbTxs []Transaction
-
-	for nb.ChainLength > cb.ChainLength {
-		for _, element := range nb.Transactions {
-			nbTxs = append(nbTxs, element)
-			if !nb.NotEmpty {
-				fmt.Print("no result found in map")
-			}
-		}
-		nb = base.blocks[nb.PrevBlockHash]
+	for _, element := range base.currentBlock.Transactions {
+		cbTxs = append(cbTxs, element)
 	}
-
-	for cb.NotEmpty && cb.getID() != nb.getID() {
-		for _, element := range cb.Transactions {
-			cbTxs = append(cbTxs, element)
-		}
-		for _, element := range nb.Transactions {
-			nbTxs = append(nbTxs, element)
-		}
-
-		if val, ok := base.blocks[cb.PrevBlockHash]; ok {
-			cb = val
-		} else {
-			cb = *new(Block)
+	for _, block := range reorg.Disconnected {
+		for _, element := range block.Transactions {
+			if indexOf(element, cbTxs) == -1 {
+				cbTxs = append(cbTxs, element)
+			}
 		}
-		nb = base.blocks[nb.PrevBlockHash]
 	}
 
-	for _, element := range nbTxs {
-		indexInCbTxs := indexOf(element, cbTxs)
-		if indexInCbTxs != -1 {
-			cbTxs = remove(cbTxs, indexInCbTxs)
+	for _, block := range reorg.Connected {
+		for _, element := range block.Transactions {
+			indexInCbTxs := indexOf(element, cbTxs)
+			if indexInCbTxs != -1 {
+				cbTxs = remove(cbTxs, indexInCbTxs)
+			}
 		}
 	}
 	return cbTxs
@@ -213,7 +296,11 @@ func indexOf(transaction Transaction, list []Transaction) int {
  *
  * @param  {...any} args - Arguments needed for Client.postTransaction.
  */
-func (base Miner) postTransaction(outputs map[string]int) bool {
-	tx := base.Client.postTransaction(outputs, DEFAULT_TX_FEE)
+func (base *Miner) postTransaction(outputs map[string]int) bool {
+	tx, err := base.Client.postTransaction(outputs, DEFAULT_TX_FEE)
+	if err != nil {
+		fmt.Printf("%v: %v\n", base.Client.name, err)
+		return false
+	}
 	return base.addTransaction(tx)
 }
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// MultisigPolicy describes a shared address.  A transaction from the
+// address needs valid signatures from Threshold of the PubKeys.
+type MultisigPolicy struct {
+	Threshold int
+	PubKeys   []MultisigKey
+}
+
+// MultisigKey is a public key of a multisig policy, of any signature scheme.
+type MultisigKey struct {
+	Scheme string
+	Key    []byte
+}
+
+// MultisigSignature is a signature by the key at KeyIndex of the policy.
+type MultisigSignature struct {
+	KeyIndex int
+	Sig      []byte
+}
+
+/**
+ * Creates an M-of-N policy.  The keys are sorted, so the same keys and
+ * threshold always give the same address.
+ *
+ * @param {Number} threshold - The number of signatures needed.
+ * @param {Array} pubKeys - The public keys that may sign; see keypair.multisigKey.
+ *
+ * @returns {MultisigPolicy} - The policy, or an error if it can never be satisfied.
+ */
+func newMultisigPolicy(threshold int, pubKeys []MultisigKey) (*MultisigPolicy, error) {
+	if threshold < 1 || threshold > len(pubKeys) {
+		return nil, errors.New("Threshold must be between 1 and the number of keys")
+	}
+	policy := new(MultisigPolicy)
+	policy.Threshold = threshold
+	policy.PubKeys = append([]MultisigKey(nil), pubKeys...)
+	sort.Slice(policy.PubKeys, func(i, j int) bool {
+		return policy.PubKeys[i].less(policy.PubKeys[j])
+	})
+	for i := 1; i < len(policy.PubKeys); i++ {
+		if policy.PubKeys[i].equals(policy.PubKeys[i-1]) {
+			return nil, errors.New("Duplicate key in multisig policy")
+		}
+	}
+	return policy, nil
+}
+
+/**
+ * Returns the public key of the keypair as a key of a multisig policy.
+ */
+func (base keypair) multisigKey() MultisigKey {
+	return MultisigKey{base.scheme(), base.publicKey()}
+}
+
+func (base MultisigKey) less(other MultisigKey) bool {
+	if base.Scheme != other.Scheme {
+		return base.Scheme < other.Scheme
+	}
+	return bytes.Compare(base.Key, other.Key) < 0
+}
+
+func (base MultisigKey) equals(other MultisigKey) bool {
+	return base.Scheme == other.Scheme && bytes.Equal(base.Key, other.Key)
+}
+
+/**
+ * Writes the policy into a canonical encoding.
+ */
+func (base MultisigPolicy) encode(enc *txEncoder) {
+	enc.writeInt(int64(base.Threshold))
+	enc.writeInt(int64(len(base.PubKeys)))
+	for _, pubKey := range base.PubKeys {
+		enc.writeString(pubKey.Scheme)
+		enc.writeBytes(pubKey.Key)
+	}
+}
+
+/**
+ * Calculates the address of the policy from its threshold and keys.
+ *
+ * @returns {String} - The multisig address.
+ */
+func (base MultisigPolicy) address() string {
+	enc := new(txEncoder)
+	base.encode(enc)
+	return encodeAddress(MULTISIG_ADDRESS_VERSION, keyHash("multisig", enc.buf.Bytes()))
+}
+
+/**
+ * Finds the index of a public key in the policy.
+ *
+ * @returns {Number} - The index of the key, or -1 if the key is not part of the policy.
+ */
+func (base MultisigPolicy) keyIndex(pubKey MultisigKey) int {
+	for i, key := range base.PubKeys {
+		if key.equals(pubKey) {
+			return i
+		}
+	}
+	return -1
+}
+
+/**
+ * Creates an unsigned transaction from a multisig address.  The keys of
+ * the policy then sign it with signMultisigTransaction.
+ *
+ * @param {MultisigPolicy} policy - The policy of the sending address.
+ * @param {Number} nonce - The next nonce of the multisig address.
+ * @param {Object} outputs - The addresses and amounts to pay.
+ * @param {Number} fee - The transaction fee reward to pay the miner.
+ *
+ * @returns {Transaction} - The unsigned transaction.
+ */
+func newMultisigTransaction(policy *MultisigPolicy, nonce int, outputs map[string]int, fee int) *Transaction {
+	transaction := newTransaction(policy.address(), nonce, rsa.PublicKey{}, nil, outputs, fee, "")
+	transaction.Multisig = policy
+	transaction.Id = getID(*transaction)
+	return transaction
+}
+
+/**
+ * Adds the signature of one key of the policy to a multisig transaction,
+ * replacing any earlier signature by the same key.
+ *
+ * @param {keypair} kp - The keypair of one of the policy keys.
+ * @param {Transaction} transaction - The multisig transaction to sign.
+ *
+ * @returns {Boolean} - False if the key is not part of the policy.
+ */
+func signMultisigTransaction(kp keypair, transaction *Transaction) bool {
+	if transaction.Multisig == nil || kp.isEmpty() {
+		return false
+	}
+	index := transaction.Multisig.keyIndex(kp.multisigKey())
+	if index == -1 {
+		return false
+	}
+	id := getID(*transaction)
+	transaction.Id = id
+	sig := MultisigSignature{index, kp.signBytes(id)}
+	for i, existing := range transaction.Sigs {
+		if existing.KeyIndex == index {
+			transaction.Sigs[i] = sig
+			return true
+		}
+	}
+	transaction.Sigs = append(transaction.Sigs, sig)
+	return true
+}
+
+/**
+ * Determines whether a multisig transaction comes from the address of its
+ * policy and carries valid signatures from enough distinct keys.
+ *
+ * @returns {Boolean} - Validity of the signatures and from address.
+ */
+func validMultisigTransaction(transaction Transaction) bool {
+	policy := transaction.Multisig
+	id := getID(transaction)
+	if id == "" || id != transaction.Id || transaction.From != policy.address() {
+		return false
+	}
+	if policy.Threshold < 1 || policy.Threshold > len(policy.PubKeys) {
+		return false
+	}
+	signed := make(map[int]bool)
+	for _, sig := range transaction.Sigs {
+		if sig.KeyIndex < 0 || sig.KeyIndex >= len(policy.PubKeys) || signed[sig.KeyIndex] {
+			continue
+		}
+		pubKey := policy.PubKeys[sig.KeyIndex]
+		if verifySchemeSignature(pubKey.Scheme, pubKey.Key, id, sig.Sig) == nil {
+			signed[sig.KeyIndex] = true
+		}
+	}
+	return len(signed) >= policy.Threshold
+}
+
+/**
+ * Starts a transaction from a multisig address that the client holds one
+ * of the keys for, signed by the client.  The other key holders add their
+ * signatures with cosignTransaction before it is submitted.
+ *
+ * @param {MultisigPolicy} policy - The policy of the sending address.
+ * @param {Object} outputs - The addresses and amounts to pay.
+ * @param {Number} fee - The transaction fee reward to pay the miner.
+ *
+ * @returns {Transaction} - The transaction, or an error if the client is not a key holder.
+ */
+func (base *Client) proposeMultisigTransaction(policy *MultisigPolicy, outputs map[string]int, fee int) (Transaction, error) {
+	if err := validateRecipients(outputs); err != nil {
+		return Transaction{}, err
+	}
+	tx := newMultisigTransaction(policy, base.lastBlock.nextNonce(policy.address()), outputs, fee)
+	if !base.cosignTransaction(tx) {
+		return *tx, errors.New("Client does not hold a key of the multisig policy")
+	}
+	return *tx, nil
+}
+
+/**
+ * Adds the client's signature to a multisig transaction.
+ *
+ * @param {Transaction} tx - The multisig transaction to sign.
+ *
+ * @returns {Boolean} - False if the client does not hold a key of the policy.
+ */
+func (base *Client) cosignTransaction(tx *Transaction) bool {
+	return signMultisigTransaction(base.keypairClient, tx)
+}
+
+/**
+ * Broadcasts a multisig transaction once it has enough signatures.
+ *
+ * @param {Transaction} tx - The signed multisig transaction.
+ */
+func (base *Client) submitMultisigTransaction(tx Transaction) error {
+	if tx.Multisig == nil || !validMultisigTransaction(tx) {
+		return errors.New("Multisig transaction does not have enough valid signatures")
+	}
+	txJSON, err := json.Marshal(tx)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%s: Submitting multisig transaction %s\n", base.name, tx.Id)
+	base.fakeNet.broadcast(POST_TRANSACTION, txJSON)
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+// Limits for blocks whose previous block has not arrived yet.
+// Orphans are dropped after ORPHAN_EXPIRY milliseconds, and a missing
+// block is requested again if it has not arrived after ORPHAN_REREQUEST_INTERVAL.
+const MAX_ORPHAN_BLOCKS int = 100
+const ORPHAN_EXPIRY int64 = 10 * 60 * 1000
+const ORPHAN_REREQUEST_INTERVAL int64 = 5 * 1000
+
+type orphanBlock struct {
+	block    Block
+	received int64
+}
+
+// orphanPool holds blocks that cannot be connected to the chain yet,
+// grouped by the ID of the previous block they are waiting for.
+type orphanPool struct {
+	byParent  map[string]map[string]orphanBlock
+	parentOf  map[string]string
+	requested map[string]int64
+}
+
+func newOrphanPool() *orphanPool {
+	pool := new(orphanPool)
+	pool.byParent = make(map[string]map[string]orphanBlock)
+	pool.parentOf = make(map[string]string)
+	pool.requested = make(map[string]int64)
+	return pool
+}
+
+/**
+ * Determines whether a block is waiting in the pool.
+ *
+ * @param {String} id - The ID of the block.
+ */
+func (base *orphanPool) contains(id string) bool {
+	_, ok := base.parentOf[id]
+	return ok
+}
+
+/**
+ * Adds a block to the pool, making room for it if the pool is full.
+ *
+ * @param {Block} block - The block whose previous block is missing.
+ * @param {Number} now - The current time in milliseconds.
+ *
+ * @returns {Boolean} - True if the previous block should be requested,
+ *    because it has not been requested yet or was requested too long ago.
+ */
+func (base *orphanPool) add(block Block, now int64) bool {
+	base.expire(now)
+
+	id := block.getID()
+	if !base.contains(id) {
+		if len(base.parentOf) >= MAX_ORPHAN_BLOCKS {
+			base.removeOldest()
+		}
+		children, ok := base.byParent[block.PrevBlockHash]
+		if !ok {
+			children = make(map[string]orphanBlock)
+			base.byParent[block.PrevBlockHash] = children
+		}
+		children[id] = orphanBlock{block, now}
+		base.parentOf[id] = block.PrevBlockHash
+	}
+
+	lastRequest, ok := base.requested[block.PrevBlockHash]
+	if ok && now-lastRequest < ORPHAN_REREQUEST_INTERVAL {
+		return false
+	}
+	base.requested[block.PrevBlockHash] = now
+	return true
+}
+
+/**
+ * Removes and returns every block that was waiting for the given block.
+ *
+ * @param {String} parentID - The ID of the block that just arrived.
+ *
+ * @returns {Array} - The blocks that can now be connected.
+ */
+func (base *orphanPool) take(parentID string) []Block {
+	var blocks []Block
+	for id, orphan := range base.byParent[parentID] {
+		blocks = append(blocks, orphan.block)
+		delete(base.parentOf, id)
+	}
+	delete(base.byParent, parentID)
+	delete(base.requested, parentID)
+	return blocks
+}
+
+/**
+ * Drops every block that has been waiting for longer than ORPHAN_EXPIRY.
+ *
+ * @param {Number} now - The current time in milliseconds.
+ */
+func (base *orphanPool) expire(now int64) {
+	for parentID, children := range base.byParent {
+		for id, orphan := range children {
+			if now-orphan.received > ORPHAN_EXPIRY {
+				base.remove(parentID, id)
+			}
+		}
+	}
+}
+
+func (base *orphanPool) removeOldest() {
+	var oldestParent, oldestID string
+	var oldest int64
+	for parentID, children := range base.byParent {
+		for id, orphan := range children {
+			if oldestID == "" || orphan.received < oldest {
+				oldestParent, oldestID, oldest = parentID, id, orphan.received
+			}
+		}
+	}
+	if oldestID != "" {
+		base.remove(oldestParent, oldestID)
+	}
+}
+
+func (base *orphanPool) remove(parentID string, id string) {
+	delete(base.byParent[parentID], id)
+	delete(base.parentOf, id)
+	if len(base.byParent[parentID]) == 0 {
+		delete(base.byParent, parentID)
+		delete(base.requested, parentID)
+	}
+}
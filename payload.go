@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Typed payloads are stored in Transaction.Data as "<type>:<body>".
+// The whole Data field may be at most MAX_PAYLOAD_SIZE bytes.
+const PAYLOAD_SEPARATOR = ":"
+const MAX_PAYLOAD_SIZE int = 1024
+
+// Built-in payload types.  A memo is a line of text for the recipient,
+// and a record is a JSON object stored on the chain.
+const PAYLOAD_MEMO string = "memo"
+const PAYLOAD_RECORD string = "record"
+
+// PayloadValidator checks the body of a payload of one type.  It gets the
+// transaction and the block it is being added to, so that a payload can
+// depend on the state of the chain.
+type PayloadValidator func(body string, tx Transaction, block Block) error
+
+/**
+ * Returns the payload types that every chain accepts.
+ */
+func defaultPayloadTypes() map[string]PayloadValidator {
+	return map[string]PayloadValidator{
+		PAYLOAD_MEMO:   validateMemo,
+		PAYLOAD_RECORD: validateRecord,
+	}
+}
+
+/**
+ * Registers a new payload type, whose payloads are checked by the given
+ * validator.  Every node of the chain must register the same types.
+ *
+ * @param {String} payloadType - The type tag, which may not contain the separator.
+ * @param {PayloadValidator} validator - The validator for the payload bodies.
+ */
+func (base *BlockChaincfg) registerPayloadType(payloadType string, validator PayloadValidator) error {
+	if payloadType == "" || strings.Contains(payloadType, PAYLOAD_SEPARATOR) {
+		return errors.New("Invalid payload type")
+	}
+	if _, ok := base.payloadTypes[payloadType]; ok {
+		return errors.New("Payload type " + payloadType + " is already registered")
+	}
+	base.payloadTypes[payloadType] = validator
+	return nil
+}
+
+/**
+ * Builds the Data field for a payload.
+ *
+ * @param {String} payloadType - The type tag of the payload.
+ * @param {String} body - The body of the payload.
+ *
+ * @returns {String} - The encoded payload.
+ */
+func encodePayload(payloadType string, body string) string {
+	return payloadType + PAYLOAD_SEPARATOR + body
+}
+
+/**
+ * Splits a Data field into its type tag and body.
+ *
+ * @param {String} data - The Data field of a transaction.
+ *
+ * @returns {String} - The type tag and the body, or an error if there is no type tag.
+ */
+func parsePayload(data string) (string, string, error) {
+	i := strings.Index(data, PAYLOAD_SEPARATOR)
+	if i <= 0 {
+		return "", "", errors.New("Payload has no type")
+	}
+	return data[:i], data[i+len(PAYLOAD_SEPARATOR):], nil
+}
+
+/**
+ * Validates the payload of a transaction against the payload types of the
+ * block's chain.  A transaction without Data has no payload and is valid.
+ *
+ * @param {Transaction} tx - The transaction to check.
+ *
+ * @returns {Error} - Why the payload is invalid, or nil.
+ */
+func (base Block) validatePayload(tx Transaction) error {
+	if tx.Data == "" {
+		return nil
+	}
+	cfg := base.config()
+	if len(tx.Data) > cfg.maxPayloadSize {
+		return errors.New("Payload is too large")
+	}
+	payloadType, body, err := parsePayload(tx.Data)
+	if err != nil {
+		return err
+	}
+	validator, ok := cfg.payloadTypes[payloadType]
+	if !ok {
+		return errors.New("Unknown payload type " + payloadType)
+	}
+	return validator(body, tx, base)
+}
+
+func validateMemo(body string, tx Transaction, block Block) error {
+	if !utf8.ValidString(body) {
+		return errors.New("Memo is not valid UTF-8")
+	}
+	for _, r := range body {
+		if unicode.IsControl(r) {
+			return errors.New("Memo contains control characters")
+		}
+	}
+	return nil
+}
+
+func validateRecord(body string, tx Transaction, block Block) error {
+	var record map[string]interface{}
+	if err := json.Unmarshal([]byte(body), &record); err != nil || record == nil {
+		return errors.New("Record is not a JSON object")
+	}
+	return nil
+}
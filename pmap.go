@@ -0,0 +1,222 @@
+package main
+
+import (
+	"hash/fnv"
+	"math/bits"
+)
+
+// Each level of a pmap trie uses PMAP_BITS bits of the key's hash.  Keys
+// whose hashes agree on every bit are kept side by side at the bottom.
+const PMAP_BITS uint = 6
+const PMAP_MAX_SHIFT uint = 64 - PMAP_BITS
+
+// pmap is a persistent map from strings to values, stored as a hash array
+// mapped trie.  Setting or deleting a key copies only the nodes on the path
+// to that key and returns a new map; every other node is shared with the
+// old map, which is left unchanged.
+type pmap struct {
+	root *pmapNode
+	size int
+}
+
+type pmapNode struct {
+	bitmap uint64
+	slots  []pmapSlot
+}
+
+// A slot holds either a key and its value, or a child node.
+type pmapSlot struct {
+	key   string
+	value interface{}
+	node  *pmapNode
+}
+
+func pmapHash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+/**
+ * Looks up a key.
+ *
+ * @param {String} key - The key to look up.
+ *
+ * @returns {Object} - The value, and false if the key is not in the map.
+ */
+func (base pmap) get(key string) (interface{}, bool) {
+	h := pmapHash(key)
+	node := base.root
+	for shift := uint(0); node != nil; shift += PMAP_BITS {
+		if shift > PMAP_MAX_SHIFT {
+			for _, slot := range node.slots {
+				if slot.key == key {
+					return slot.value, true
+				}
+			}
+			return nil, false
+		}
+		bit := uint64(1) << ((h >> shift) & (1<<PMAP_BITS - 1))
+		if node.bitmap&bit == 0 {
+			return nil, false
+		}
+		slot := node.slots[bits.OnesCount64(node.bitmap&(bit-1))]
+		if slot.node == nil {
+			if slot.key == key {
+				return slot.value, true
+			}
+			return nil, false
+		}
+		node = slot.node
+	}
+	return nil, false
+}
+
+/**
+ * Returns a map with the key set to the value.
+ */
+func (base pmap) set(key string, value interface{}) pmap {
+	root, added := base.root.set(pmapHash(key), 0, key, value)
+	if added {
+		return pmap{root, base.size + 1}
+	}
+	return pmap{root, base.size}
+}
+
+/**
+ * Returns a map without the key.
+ */
+func (base pmap) delete(key string) pmap {
+	root, removed := base.root.delete(pmapHash(key), 0, key)
+	if removed {
+		return pmap{root, base.size - 1}
+	}
+	return base
+}
+
+/**
+ * Calls the function for every key and value, in no particular order.
+ */
+func (base pmap) each(fn func(key string, value interface{})) {
+	base.root.each(fn)
+}
+
+func (base *pmapNode) set(h uint64, shift uint, key string, value interface{}) (*pmapNode, bool) {
+	if base == nil {
+		base = new(pmapNode)
+	}
+	if shift > PMAP_MAX_SHIFT {
+		for i, slot := range base.slots {
+			if slot.key == key {
+				return base.withSlot(i, pmapSlot{key: key, value: value}), false
+			}
+		}
+		node := base.copy()
+		node.slots = append(node.slots, pmapSlot{key: key, value: value})
+		return node, true
+	}
+
+	bit := uint64(1) << ((h >> shift) & (1<<PMAP_BITS - 1))
+	index := bits.OnesCount64(base.bitmap & (bit - 1))
+	if base.bitmap&bit == 0 {
+		node := new(pmapNode)
+		node.bitmap = base.bitmap | bit
+		node.slots = make([]pmapSlot, 0, len(base.slots)+1)
+		node.slots = append(node.slots, base.slots[:index]...)
+		node.slots = append(node.slots, pmapSlot{key: key, value: value})
+		node.slots = append(node.slots, base.slots[index:]...)
+		return node, true
+	}
+
+	slot := base.slots[index]
+	if slot.node != nil {
+		child, added := slot.node.set(h, shift+PMAP_BITS, key, value)
+		return base.withSlot(index, pmapSlot{node: child}), added
+	}
+	if slot.key == key {
+		return base.withSlot(index, pmapSlot{key: key, value: value}), false
+	}
+	// Two keys share this slot, so both move down into a new child.
+	child, _ := (*pmapNode)(nil).set(pmapHash(slot.key), shift+PMAP_BITS, slot.key, slot.value)
+	child, _ = child.set(h, shift+PMAP_BITS, key, value)
+	return base.withSlot(index, pmapSlot{node: child}), true
+}
+
+func (base *pmapNode) delete(h uint64, shift uint, key string) (*pmapNode, bool) {
+	if base == nil {
+		return nil, false
+	}
+	if shift > PMAP_MAX_SHIFT {
+		for i, slot := range base.slots {
+			if slot.key == key {
+				return base.withoutSlot(i, 0), true
+			}
+		}
+		return base, false
+	}
+
+	bit := uint64(1) << ((h >> shift) & (1<<PMAP_BITS - 1))
+	if base.bitmap&bit == 0 {
+		return base, false
+	}
+	index := bits.OnesCount64(base.bitmap & (bit - 1))
+	slot := base.slots[index]
+	if slot.node == nil {
+		if slot.key != key {
+			return base, false
+		}
+		return base.withoutSlot(index, bit), true
+	}
+
+	child, removed := slot.node.delete(h, shift+PMAP_BITS, key)
+	if !removed {
+		return base, false
+	}
+	if child == nil {
+		return base.withoutSlot(index, bit), true
+	}
+	// A child left with a single key is folded back into this node.
+	if len(child.slots) == 1 && child.slots[0].node == nil {
+		return base.withSlot(index, child.slots[0]), true
+	}
+	return base.withSlot(index, pmapSlot{node: child}), true
+}
+
+func (base *pmapNode) each(fn func(key string, value interface{})) {
+	if base == nil {
+		return
+	}
+	for _, slot := range base.slots {
+		if slot.node != nil {
+			slot.node.each(fn)
+		} else {
+			fn(slot.key, slot.value)
+		}
+	}
+}
+
+func (base *pmapNode) copy() *pmapNode {
+	node := new(pmapNode)
+	node.bitmap = base.bitmap
+	node.slots = append([]pmapSlot(nil), base.slots...)
+	return node
+}
+
+func (base *pmapNode) withSlot(index int, slot pmapSlot) *pmapNode {
+	node := base.copy()
+	node.slots[index] = slot
+	return node
+}
+
+// Returns a copy without the slot at the index, or nil if it was the last one.
+func (base *pmapNode) withoutSlot(index int, bit uint64) *pmapNode {
+	if len(base.slots) == 1 {
+		return nil
+	}
+	node := new(pmapNode)
+	node.bitmap = base.bitmap &^ bit
+	node.slots = make([]pmapSlot, 0, len(base.slots)-1)
+	node.slots = append(node.slots, base.slots[:index]...)
+	node.slots = append(node.slots, base.slots[index+1:]...)
+	return node
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Event emitted by a client whenever the tip of its best chain changes.
+const CHAIN_REORG string = "CHAIN_REORG"
+
+// ChainReorg describes a change of the best chain.  When the new tip simply
+// extends the old one, Disconnected is empty.
+type ChainReorg struct {
+	OldTip         Block
+	NewTip         Block
+	CommonAncestor Block
+	// Blocks removed from the best chain, from the old tip backwards.
+	Disconnected []Block
+	// Blocks added to the best chain, from the common ancestor forwards.
+	Connected []Block
+}
+
+/**
+ * Walks back from two tips to their common ancestor, collecting the blocks
+ * that leave and join the best chain.
+ *
+ * @param {Block} oldTip - The tip of the current best chain.
+ * @param {Block} newTip - The tip of the new best chain.
+ *
+ * @returns {ChainReorg} - The blocks to disconnect and to connect.
+ */
+func (base *Client) findReorg(oldTip Block, newTip Block) ChainReorg {
+	reorg := ChainReorg{OldTip: oldTip, NewTip: newTip}
+	ob := oldTip
+	nb := newTip
+	var connected []Block
+
+	for ob.NotEmpty && ob.ChainLength > nb.ChainLength {
+		reorg.Disconnected = append(reorg.Disconnected, ob)
+		ob, _ = base.getBlock(ob.PrevBlockHash)
+	}
+	for nb.NotEmpty && nb.ChainLength > ob.ChainLength {
+		connected = append(connected, nb)
+		nb, _ = base.getBlock(nb.PrevBlockHash)
+	}
+	for ob.NotEmpty && nb.NotEmpty && ob.getID() != nb.getID() {
+		reorg.Disconnected = append(reorg.Disconnected, ob)
+		connected = append(connected, nb)
+		ob, _ = base.getBlock(ob.PrevBlockHash)
+		nb, _ = base.getBlock(nb.PrevBlockHash)
+	}
+	reorg.CommonAncestor = nb
+
+	// Connected blocks were collected from the new tip backwards.
+	for i := len(connected) - 1; i >= 0; i-- {
+		reorg.Connected = append(reorg.Connected, connected[i])
+	}
+	return reorg
+}
+
+/**
+ * Determines whether a transaction is in one of the connected blocks.
+ *
+ * @param {Transaction} tx - The transaction that we are checking for.
+ */
+func (base ChainReorg) connects(tx Transaction) bool {
+	for _, block := range base.Connected {
+		if block.contains(tx) {
+			return true
+		}
+	}
+	return false
+}
+
+/**
+ * Makes the given block the tip of the best chain.  Outgoing transactions
+ * that were only included in abandoned blocks become pending again, and
+ * a CHAIN_REORG event is emitted so that miners can rebuild their blocks.
+ *
+ * @param {Block} newTip - The tip of the chain with the most work.
+ */
+func (base *Client) switchChain(newTip Block) {
+	reorg := base.findReorg(base.lastBlock, newTip)
+	base.lastBlock = newTip
+	if err := base.blocks.setTip(newTip.getID()); err != nil {
+		fmt.Printf("%s: Could not store new tip: %v\n", base.name, err)
+	}
+
+	if len(reorg.Disconnected) > 0 {
+		fmt.Printf("%s: Reorganizing, %d blocks disconnected and %d connected since block %d\n", base.name, len(reorg.Disconnected), len(reorg.Connected), reorg.CommonAncestor.ChainLength)
+	}
+	for _, block := range reorg.Connected {
+		base.scanBlock(block)
+	}
+	for _, block := range reorg.Disconnected {
+		for _, tx := range block.Transactions {
+			if base.ownsAddress(tx.From) && !reorg.connects(tx) {
+				base.pendingOutGoingTransactionsMap[tx.Id] = tx
+			}
+		}
+	}
+	base.setLastConfirmed()
+
+	base.emitter.Emit(CHAIN_REORG, reorg)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"runtime"
+	"sync"
+)
+
+// The number of verified signatures remembered.  The oldest entries are
+// dropped first once the cache is full.
+const SIG_CACHE_SIZE int = 10000
+
+// sigCache remembers transactions whose signatures were already verified,
+// so that a transaction seen in the mempool is not verified again when a
+// block containing it arrives.  It is safe for concurrent use.
+type sigCache struct {
+	mu      sync.Mutex
+	entries map[string]bool
+	order   []string
+	size    int
+}
+
+var verifiedSignatures = newSigCache(SIG_CACHE_SIZE)
+
+func newSigCache(size int) *sigCache {
+	cache := new(sigCache)
+	cache.entries = make(map[string]bool)
+	cache.size = size
+	return cache
+}
+
+func (base *sigCache) contains(key string) bool {
+	base.mu.Lock()
+	defer base.mu.Unlock()
+	return base.entries[key]
+}
+
+func (base *sigCache) add(key string) {
+	base.mu.Lock()
+	defer base.mu.Unlock()
+	if base.entries[key] {
+		return
+	}
+	if len(base.order) >= base.size {
+		delete(base.entries, base.order[0])
+		base.order = base.order[1:]
+	}
+	base.entries[key] = true
+	base.order = append(base.order, key)
+}
+
+/**
+ * Computes the cache key of a transaction from its ID and signatures.
+ * The ID covers the sender and its keys, so a cached signature is only
+ * reused for exactly the same signed transaction.
+ *
+ * @returns {String} - The cache key, and false if the ID does not match the transaction.
+ */
+func sigCacheKey(transaction Transaction) (string, bool) {
+	id := getID(transaction)
+	if id == "" || id != transaction.Id {
+		return "", false
+	}
+	enc := new(txEncoder)
+	enc.writeString(id)
+	enc.writeBytes(transaction.Sig)
+	for _, sig := range transaction.Sigs {
+		enc.writeInt(int64(sig.KeyIndex))
+		enc.writeBytes(sig.Sig)
+	}
+	return sha256hash(enc.buf.String()), true
+}
+
+/**
+ * Verifies the signatures of many transactions at once, spread over one
+ * goroutine per CPU.  Valid signatures are added to the cache, so the
+ * transactions can afterwards be applied one by one without verifying
+ * them again.
+ *
+ * @param {Array} txs - The transactions to verify.
+ *
+ * @returns {Boolean} - True if every transaction has a valid signature.
+ */
+func verifySignatures(txs []Transaction) bool {
+	jobs := make(chan Transaction)
+	results := make(chan bool, len(txs))
+
+	var wg sync.WaitGroup
+	for i := 0; i < runtime.NumCPU(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for tx := range jobs {
+				results <- validSignatureTransaction(tx)
+			}
+		}()
+	}
+	for _, tx := range txs {
+		jobs <- tx
+	}
+	close(jobs)
+	wg.Wait()
+	close(results)
+
+	for valid := range results {
+		if !valid {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"errors"
+)
+
+// Signature schemes a transaction may be signed with.  Transactions signed
+// with RSA, the original scheme, keep their key in Transaction.PubKey and
+// have no scheme identifier, so their IDs and signatures are unchanged.
+const SIG_SCHEME_RSA string = "rsa"
+const SIG_SCHEME_ED25519 string = "ed25519"
+const SIG_SCHEME_ECDSA_P256 string = "ecdsa-p256"
+
+// The scheme of keys that are generated when no scheme is asked for.
+// RSA keys are only kept for clients that already have them.
+const DEFAULT_SIG_SCHEME = SIG_SCHEME_ED25519
+
+// Signer holds a private key of some signature scheme.
+type Signer interface {
+	scheme() string
+	publicKey() []byte
+	sign(message string) []byte
+}
+
+// SignatureScheme creates keys of a scheme and verifies its signatures.
+type SignatureScheme interface {
+	generate() (Signer, error)
+	verify(pubKey []byte, message string, sig []byte) error
+}
+
+// The signature schemes that transactions may name, besides RSA.
+var signatureSchemes = map[string]SignatureScheme{
+	SIG_SCHEME_ED25519:    ed25519Scheme{},
+	SIG_SCHEME_ECDSA_P256: ecdsaP256Scheme{},
+}
+
+/**
+ * Generates a keypair for the given scheme.
+ *
+ * @param {String} scheme - One of the SIG_SCHEME constants.
+ *
+ * @returns {keypair} - The new keypair, or an error for an unknown scheme.
+ */
+func generateSchemeKeypair(scheme string) (keypair, error) {
+	if scheme == SIG_SCHEME_RSA {
+		return generateKeypair(), nil
+	}
+	s, ok := signatureSchemes[scheme]
+	if !ok {
+		return keypair{}, errors.New("Unknown signature scheme " + scheme)
+	}
+	signer, err := s.generate()
+	if err != nil {
+		return keypair{}, err
+	}
+	return keypair{signer: signer}, nil
+}
+
+/**
+ * Calculates the address of a public key of a scheme other than RSA.  The
+ * scheme is part of the hashed key, so keys of different schemes never
+ * share an address.
+ *
+ * @param {String} scheme - The signature scheme.
+ * @param {[]byte} pubKey - The encoded public key.
+ *
+ * @returns {String} - The address.
+ */
+func calcSchemeAddress(scheme string, pubKey []byte) string {
+	return encodeAddress(ADDRESS_VERSION, keyHash(scheme, pubKey))
+}
+
+/**
+ * Determines whether the keypair holds no key yet.
+ */
+func (base keypair) isEmpty() bool {
+	return base.signer == nil && base.pubKey.N == nil
+}
+
+/**
+ * Calculates the address of the keypair.
+ *
+ * @returns {String} - The address.
+ */
+func (base keypair) address() string {
+	if base.signer == nil {
+		return calcAddress(&base.pubKey)
+	}
+	return calcSchemeAddress(base.signer.scheme(), base.signer.publicKey())
+}
+
+/**
+ * Returns the signature scheme of the keypair.
+ */
+func (base keypair) scheme() string {
+	if base.signer == nil {
+		return SIG_SCHEME_RSA
+	}
+	return base.signer.scheme()
+}
+
+/**
+ * Returns the encoded public key of the keypair.  RSA keys are encoded in
+ * PKCS #1 form.
+ */
+func (base keypair) publicKey() []byte {
+	if base.signer == nil {
+		return x509.MarshalPKCS1PublicKey(&base.pubKey)
+	}
+	return base.signer.publicKey()
+}
+
+/**
+ * Signs a message with the private key of the keypair.
+ *
+ * @param {String} message - The message to sign.
+ *
+ * @returns {[]byte} - The signature.
+ */
+func (base keypair) signBytes(message string) []byte {
+	if base.signer == nil {
+		return sign(base.privKey, message)
+	}
+	return base.signer.sign(message)
+}
+
+/**
+ * Signs a transaction with the keypair, first recording the public key
+ * and scheme in the transaction.
+ *
+ * @param {Transaction} tx - The transaction to sign.
+ */
+func (base keypair) sign(tx *Transaction) {
+	if base.signer == nil {
+		tx.PubKey = base.pubKey
+		signTransaction(base.privKey, tx)
+		return
+	}
+	tx.PubKey = rsa.PublicKey{}
+	tx.Scheme = base.signer.scheme()
+	tx.SchemeKey = base.signer.publicKey()
+	id := getID(*tx)
+	tx.Id = id
+	tx.Sig = base.signer.sign(id)
+}
+
+/**
+ * Verifies a signature made with a key of any scheme, including RSA.
+ *
+ * @param {String} scheme - The signature scheme.
+ * @param {[]byte} pubKey - The encoded public key, as returned by keypair.publicKey.
+ * @param {String} message - The signed message.
+ * @param {[]byte} sig - The signature.
+ *
+ * @returns {error} - nil if the signature is valid.
+ */
+func verifySchemeSignature(scheme string, pubKey []byte, message string, sig []byte) error {
+	if scheme == SIG_SCHEME_RSA {
+		rsaKey, err := x509.ParsePKCS1PublicKey(pubKey)
+		if err != nil {
+			return err
+		}
+		return verifySignature(rsaKey, message, sig)
+	}
+	s, ok := signatureSchemes[scheme]
+	if !ok {
+		return errors.New("Unknown signature scheme " + scheme)
+	}
+	return s.verify(pubKey, message, sig)
+}
+
+/**
+ * Creates a client with a new keypair of the given scheme.
+ *
+ * @param {String} name - The client's name, used for debugging messages.
+ * @param {String} scheme - One of the SIG_SCHEME constants.
+ * @param {Block} startingBlock - The genesis block, or an empty block.
+ * @param {FakeNet} fakeNet - The network the client uses.
+ */
+func newClientWithScheme(name string, scheme string, startingBlock Block, fakeNet *FakeNet) (*Client, error) {
+	kp, err := generateSchemeKeypair(scheme)
+	if err != nil {
+		return nil, err
+	}
+	return newClient(name, kp, startingBlock, fakeNet), nil
+}
+
+/**
+ * Creates a miner with a new keypair of the given scheme.
+ *
+ * @param {String} name - The miner's name, used for debugging messages.
+ * @param {String} scheme - One of the SIG_SCHEME constants.
+ * @param {Block} startingBlock - The genesis block, or an empty block.
+ * @param {FakeNet} fakeNet - The network the miner uses.
+ */
+func newMinerWithScheme(name string, scheme string, startingBlock Block, fakeNet *FakeNet) (*Miner, error) {
+	kp, err := generateSchemeKeypair(scheme)
+	if err != nil {
+		return nil, err
+	}
+	return newMiner(name, kp, startingBlock, fakeNet), nil
+}
+
+/**
+ * Verifies the signature of a transaction signed with a scheme other than
+ * RSA, and that the sender's address belongs to the key.
+ *
+ * @returns {Boolean} - Validity of the signature and from address.
+ */
+func validSchemeSignature(transaction Transaction) bool {
+	s, ok := signatureSchemes[transaction.Scheme]
+	if !ok || len(transaction.Sig) == 0 {
+		return false
+	}
+	if transaction.From != calcSchemeAddress(transaction.Scheme, transaction.SchemeKey) {
+		return false
+	}
+	return s.verify(transaction.SchemeKey, transaction.Id, transaction.Sig) == nil
+}
+
+type ed25519Scheme struct{}
+
+type ed25519Signer struct {
+	privKey ed25519.PrivateKey
+}
+
+func (ed25519Scheme) generate() (Signer, error) {
+	_, privKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return ed25519Signer{privKey}, nil
+}
+
+func (ed25519Scheme) verify(pubKey []byte, message string, sig []byte) error {
+	if len(pubKey) != ed25519.PublicKeySize || !ed25519.Verify(ed25519.PublicKey(pubKey), []byte(message), sig) {
+		return errors.New("Invalid Ed25519 signature")
+	}
+	return nil
+}
+
+func (base ed25519Signer) scheme() string {
+	return SIG_SCHEME_ED25519
+}
+
+func (base ed25519Signer) publicKey() []byte {
+	return []byte(base.privKey.Public().(ed25519.PublicKey))
+}
+
+func (base ed25519Signer) sign(message string) []byte {
+	return ed25519.Sign(base.privKey, []byte(message))
+}
+
+type ecdsaP256Scheme struct{}
+
+type ecdsaP256Signer struct {
+	privKey *ecdsa.PrivateKey
+}
+
+func (ecdsaP256Scheme) generate() (Signer, error) {
+	privKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return ecdsaP256Signer{privKey}, nil
+}
+
+func (ecdsaP256Scheme) verify(pubKey []byte, message string, sig []byte) error {
+	x, y := elliptic.UnmarshalCompressed(elliptic.P256(), pubKey)
+	if x == nil {
+		return errors.New("Invalid ECDSA P-256 public key")
+	}
+	digest := sha256.Sum256([]byte(message))
+	if !ecdsa.VerifyASN1(&ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}, digest[:], sig) {
+		return errors.New("Invalid ECDSA P-256 signature")
+	}
+	return nil
+}
+
+func (base ecdsaP256Signer) scheme() string {
+	return SIG_SCHEME_ECDSA_P256
+}
+
+func (base ecdsaP256Signer) publicKey() []byte {
+	return elliptic.MarshalCompressed(elliptic.P256(), base.privKey.X, base.privKey.Y)
+}
+
+func (base ecdsaP256Signer) sign(message string) []byte {
+	digest := sha256.Sum256([]byte(message))
+	sig, _ := ecdsa.SignASN1(rand.Reader, base.privKey, digest[:])
+	return sig
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// Names of the files kept in a client's data directory.
+const BLOCK_FILE_NAME = "blocks.dat"
+const TIP_FILE_NAME = "tip"
+
+// BlockStore keeps the blocks a client has accepted, indexed by hash and by height.
+type BlockStore interface {
+	// Stores a block.  Storing a block that is already present only
+	// replaces the copy kept in memory.
+	put(block Block) error
+	get(id string) (Block, bool)
+	// Returns the IDs of every stored block at the given height.
+	idsAtHeight(height int) []string
+	// Returns the greatest height of any stored block, or -1 if there is none.
+	maxHeight() int
+	// Records the ID of the client's last block, so it can resume there.
+	setTip(id string) error
+	tip() string
+}
+
+// memBlockStore keeps blocks in memory only.
+type memBlockStore struct {
+	blocks  map[string]Block
+	heights map[int][]string
+	tipID   string
+}
+
+func newMemBlockStore() *memBlockStore {
+	store := new(memBlockStore)
+	store.blocks = make(map[string]Block)
+	store.heights = make(map[int][]string)
+	return store
+}
+
+func (base *memBlockStore) put(block Block) error {
+	id := block.getID()
+	if _, ok := base.blocks[id]; !ok {
+		base.heights[block.ChainLength] = append(base.heights[block.ChainLength], id)
+	}
+	base.blocks[id] = block
+	return nil
+}
+
+func (base *memBlockStore) get(id string) (Block, bool) {
+	block, ok := base.blocks[id]
+	return block, ok
+}
+
+func (base *memBlockStore) idsAtHeight(height int) []string {
+	return base.heights[height]
+}
+
+func (base *memBlockStore) maxHeight() int {
+	max := -1
+	for height := range base.heights {
+		if height > max {
+			max = height
+		}
+	}
+	return max
+}
+
+func (base *memBlockStore) setTip(id string) error {
+	base.tipID = id
+	return nil
+}
+
+func (base *memBlockStore) tip() string {
+	return base.tipID
+}
+
+// fileBlockStore appends serialized blocks to a file in a data directory.
+// Each record is a 4-byte big-endian length followed by the block in the form
+// produced by Block.serialize.  Balances are not written to disk, so the
+// blocks read back must be rerun, as with blocks received from the network.
+type fileBlockStore struct {
+	*memBlockStore
+	dir     string
+	file    *os.File
+	offsets map[string]int64
+}
+
+/**
+ * Opens the block file in a data directory, creating the directory if needed.
+ * The blocks on disk are read back without balances; Client.loadBlocks
+ * restores them.
+ *
+ * @param {String} dir - The data directory.
+ *
+ * @returns {fileBlockStore} - The store, or an error if the directory cannot be used.
+ */
+func openFileBlockStore(dir string) (*fileBlockStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filepath.Join(dir, BLOCK_FILE_NAME), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	store := new(fileBlockStore)
+	store.memBlockStore = newMemBlockStore()
+	store.dir = dir
+	store.file = file
+	store.offsets = make(map[string]int64)
+	if err := store.readBlocks(); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	tip, err := ioutil.ReadFile(filepath.Join(dir, TIP_FILE_NAME))
+	if err == nil {
+		store.tipID = string(tip)
+	} else if !os.IsNotExist(err) {
+		file.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+/**
+ * Reads every record of the block file into the index.  A partly written
+ * record at the end of the file, left by a crash, is cut off.
+ */
+func (base *fileBlockStore) readBlocks() error {
+	if _, err := base.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(base.file)
+	var offset int64
+	for {
+		var length uint32
+		if err := binary.Read(reader, binary.BigEndian, &length); err != nil {
+			break
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			break
+		}
+		block, err := deserializeBlock(data)
+		if err != nil {
+			break
+		}
+		base.offsets[block.getID()] = offset
+		base.memBlockStore.put(block)
+		offset += 4 + int64(length)
+	}
+
+	if err := base.file.Truncate(offset); err != nil {
+		return err
+	}
+	_, err := base.file.Seek(offset, io.SeekStart)
+	return err
+}
+
+func (base *fileBlockStore) put(block Block) error {
+	id := block.getID()
+	if _, ok := base.offsets[id]; !ok {
+		offset, err := base.file.Seek(0, io.SeekEnd)
+		if err != nil {
+			return err
+		}
+		data := []byte(block.serialize())
+		record := make([]byte, 4+len(data))
+		binary.BigEndian.PutUint32(record, uint32(len(data)))
+		copy(record[4:], data)
+		if _, err := base.file.Write(record); err != nil {
+			return err
+		}
+		if err := base.file.Sync(); err != nil {
+			return err
+		}
+		base.offsets[id] = offset
+	}
+	return base.memBlockStore.put(block)
+}
+
+func (base *fileBlockStore) setTip(id string) error {
+	// Writing to a temporary file first, so the tip is never half written.
+	path := filepath.Join(base.dir, TIP_FILE_NAME)
+	if err := ioutil.WriteFile(path+".tmp", []byte(id), 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return err
+	}
+	return base.memBlockStore.setTip(id)
+}
+
+/**
+ * Closes the block file.
+ */
+func (base *fileBlockStore) close() error {
+	return base.file.Close()
+}
+
+/**
+ * Switches the client to a different block store.  If the store is empty,
+ * the blocks the client already has are written to it.  Otherwise the
+ * client's blocks are replaced by the stored ones, and the client resumes
+ * at the stored tip.
+ *
+ * @param {BlockStore} store - The store to use from now on.
+ * @param {BlockChaincfg} cfg - Settings of the stored blockchain, or nil for the defaults.
+ *
+ * @returns {error} - An error if the store could not be read or written.
+ */
+func (base *Client) useBlockStore(store BlockStore, cfg *BlockChaincfg) error {
+	if store.maxHeight() < 0 {
+		for height := 0; height <= base.blocks.maxHeight(); height++ {
+			for _, id := range base.blocks.idsAtHeight(height) {
+				block, _ := base.blocks.get(id)
+				if err := store.put(block); err != nil {
+					return err
+				}
+			}
+		}
+		if base.lastBlock.NotEmpty {
+			if err := store.setTip(base.lastBlock.getID()); err != nil {
+				return err
+			}
+		}
+		base.blocks = store
+		return nil
+	}
+
+	return base.loadBlocks(store, cfg)
+}
+
+/**
+ * Restores the balances of every stored block by rerunning the blocks in
+ * order of height, then sets lastBlock to the stored tip.
+ *
+ * @param {BlockStore} store - A store holding blocks read back from disk.
+ * @param {BlockChaincfg} cfg - Settings of the stored blockchain, or nil for the defaults.
+ */
+func (base *Client) loadBlocks(store BlockStore, cfg *BlockChaincfg) error {
+	genesisIDs := store.idsAtHeight(0)
+	if len(genesisIDs) != 1 {
+		return errors.New("Block store must hold exactly one genesis block")
+	}
+	genesis, _ := store.get(genesisIDs[0])
+	genesis.cfg = cfg
+	if err := store.put(genesis); err != nil {
+		return err
+	}
+
+	heaviest := genesis
+	for height := 1; height <= store.maxHeight(); height++ {
+		ids := append([]string(nil), store.idsAtHeight(height)...)
+		sort.Strings(ids)
+		for _, id := range ids {
+			block, _ := store.get(id)
+			prevBlock, ok := store.get(block.PrevBlockHash)
+			if !ok || !block.rerun(prevBlock) {
+				continue
+			}
+			if err := store.put(block); err != nil {
+				return err
+			}
+			if block.hasMoreWorkThan(heaviest) {
+				heaviest = block
+			}
+		}
+	}
+
+	tip, ok := store.get(store.tip())
+	if !ok {
+		tip = heaviest
+	}
+	base.lastBlock = tip
+	base.blocks = store
+	base.scanWallet()
+	base.setLastConfirmed()
+
+	// Transactions this client already posted on the stored chain used up their nonces.
+	if next := tip.nextNonce(base.address); next > base.nonce {
+		base.nonce = next
+	}
+	return nil
+}
+
+/**
+ * Reopens the data directory of a client, or starts using it if it is new.
+ *
+ * @param {String} dir - The data directory.
+ * @param {BlockChaincfg} cfg - Settings of the stored blockchain, or nil for the defaults.
+ */
+func (base *Client) openDataDir(dir string, cfg *BlockChaincfg) error {
+	store, err := openFileBlockStore(dir)
+	if err != nil {
+		return err
+	}
+	if err := base.useBlockStore(store, cfg); err != nil {
+		store.close()
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// How long the swap simulation waits for each step to reach the chain.
+const SWAP_STEP_TIMEOUT = 60 * time.Second
+
+/**
+ * Simulates an atomic swap between two separate DragonCoin networks.
+ * Alice trades 40 gold on network A for 30 of Bob's gold on network B.
+ * Both lock their gold behind the same hash, and Bob's lock times out
+ * first.  Alice claims on B, which reveals the preimage, and Bob uses the
+ * preimage to claim on A.  Run it with "swap" as the first argument.
+ */
+func atomicSwapSimulation() {
+	fmt.Println("Starting atomic swap simulation.  This may take a moment...")
+
+	aliceKeys, err := generateSchemeKeypair(DEFAULT_SIG_SCHEME)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	bobKeys, err := generateSchemeKeypair(DEFAULT_SIG_SCHEME)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	emptyKeys := keypair{}
+	emptyBlock := Block{}
+	emptyTransaction := Transaction{}
+
+	// Alice and Bob have a client on each network, using the same keys.
+	netA := newFakeNet()
+	aliceA := newClient("Alice (A)", aliceKeys, emptyBlock, netA)
+	bobA := newClient("Bob (A)", bobKeys, emptyBlock, netA)
+	minnie := newMiner("Minnie (A)", emptyKeys, emptyBlock, netA)
+
+	netB := newFakeNet()
+	aliceB := newClient("Alice (B)", aliceKeys, emptyBlock, netB)
+	bobB := newClient("Bob (B)", bobKeys, emptyBlock, netB)
+	mickey := newMiner("Mickey (B)", emptyKeys, emptyBlock, netB)
+
+	makeGenesis(emptyBlock, emptyTransaction,
+		map[string]int{aliceA.address: 100},
+		map[string]*Client{aliceA.address: aliceA, bobA.address: bobA, minnie.Client.address: minnie.Client},
+		newBlockchain())
+	makeGenesis(emptyBlock, emptyTransaction,
+		map[string]int{bobB.address: 100},
+		map[string]*Client{aliceB.address: aliceB, bobB.address: bobB, mickey.Client.address: mickey.Client},
+		newBlockchain())
+
+	netA.register([]*Client{aliceA, bobA, minnie.Client})
+	netB.register([]*Client{aliceB, bobB, mickey.Client})
+	go minnie.initialize()
+	go mickey.initialize()
+
+	showBalances := func() {
+		fmt.Printf("Network A: Alice has %v gold, Bob has %v gold.\n", aliceA.lastBlock.balanceOf(aliceA.address), aliceA.lastBlock.balanceOf(bobA.address))
+		fmt.Printf("Network B: Alice has %v gold, Bob has %v gold.\n", bobB.lastBlock.balanceOf(aliceB.address), bobB.lastBlock.balanceOf(bobB.address))
+	}
+	fmt.Println("Initial balances:")
+	showBalances()
+
+	// Only Alice knows the preimage until she claims Bob's gold.
+	preimage, hash := newHashLockSecret()
+
+	fmt.Println("Alice locks 40 gold for Bob on network A.")
+	lockA, err := aliceA.lockHashLock(bobA.address, 40, hash, aliceA.lastBlock.ChainLength+40, DEFAULT_TX_FEE)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if !waitFor(aliceA, func() bool {
+		funds, ok := bobA.lastBlock.hashLock(lockA.Id)
+		return ok && funds.Recipient == bobA.address && funds.Hash == hash
+	}) {
+		fmt.Println("Alice's lock never reached network A.")
+		return
+	}
+
+	// Bob's lock must time out well before Alice's, so that he still has
+	// time to claim on A after Alice reveals the preimage on B.
+	fmt.Println("Bob sees the lock and locks 30 gold for Alice on network B with the same hash.")
+	lockB, err := bobB.lockHashLock(aliceB.address, 30, hash, bobB.lastBlock.ChainLength+20, DEFAULT_TX_FEE)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	if !waitFor(bobB, func() bool {
+		funds, ok := aliceB.lastBlock.hashLock(lockB.Id)
+		return ok && funds.Recipient == aliceB.address && funds.Hash == hash
+	}) {
+		fmt.Println("Bob's lock never reached network B.")
+		return
+	}
+
+	fmt.Println("Alice claims Bob's gold on network B, revealing the preimage.")
+	aliceB.claimHashLock(lockB.Id, preimage, DEFAULT_TX_FEE)
+	var revealed string
+	if !waitFor(aliceB, func() bool {
+		var ok bool
+		revealed, ok = bobB.findPreimage(hash)
+		return ok
+	}) {
+		fmt.Println("Alice never claimed; Bob can take his gold back after the timeout.")
+		return
+	}
+
+	fmt.Println("Bob reads the preimage from network B and claims Alice's gold on network A.")
+	bobA.claimHashLock(lockA.Id, revealed, DEFAULT_TX_FEE)
+	if !waitFor(bobA, func() bool {
+		_, ok := aliceA.lastBlock.hashLock(lockA.Id)
+		return !ok
+	}) {
+		fmt.Println("Bob's claim never reached network A.")
+		return
+	}
+
+	fmt.Println()
+	fmt.Println("Final balances:")
+	showBalances()
+}
+
+/**
+ * Polls a condition until it holds or SWAP_STEP_TIMEOUT has passed.  In
+ * the meantime the sender resends its pending transactions, in case a
+ * miner was not listening yet when they were first posted.
+ *
+ * @param {Client} sender - The client whose transaction is awaited.
+ * @param {Function} condition - The condition to wait for.
+ *
+ * @returns {Boolean} - True if the condition held in time.
+ */
+func waitFor(sender *Client, condition func() bool) bool {
+	deadline := time.Now().Add(SWAP_STEP_TIMEOUT)
+	for time.Now().Before(deadline) {
+		if condition() {
+			return true
+		}
+		time.Sleep(time.Second)
+		sender.resendPendingTransactions()
+	}
+	return false
+}
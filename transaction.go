@@ -3,22 +3,43 @@ package main
 import (
 	"bytes"
 	"crypto/rsa"
+	"encoding/binary"
 	"fmt"
-	"strconv"
+	"math"
+	"sort"
 	"strings"
 )
 
 const TX_CONST = "TX"
 
-// TransactionIO is apart of Transaction
+// Version of the canonical transaction encoding.  The domain tag keeps the
+// hashed and signed bytes of a transaction from ever matching those of
+// any other kind of message.
+const TX_VERSION int = 1
+const TX_DOMAIN_TAG = "DRAGONCOIN/" + TX_CONST + "/v1"
+
+// OutPoint names an output of an earlier transaction.
+type OutPoint struct {
+	TxID  string
+	Index int
+}
+
+// TxOutput is an amount of gold paid to an address.
+type TxOutput struct {
+	Address string
+	Amount  int
+}
+
+// TransactionIO is apart of Transaction.  It is only used in UTXO mode,
+// where a transaction spends explicit outputs of earlier transactions.
 type TransactionIO struct {
-	inputs  []string
-	outputs []string
+	Inputs  []OutPoint
+	Outputs []TxOutput
 }
 
 // Transaction object
 type Transaction struct {
-	//tranctionIO TransactionIO
+	Version int
 	From    string
 	Nonce   int
 	PubKey  rsa.PublicKey
@@ -27,10 +48,28 @@ type Transaction struct {
 	Fee     int
 	Data    string
 	Id      string
+	// Inputs and outputs in UTXO mode; Outputs is unused then.
+	IO *TransactionIO `json:",omitempty"`
+	// Only blocks above ValidAfterHeight and below ExpiresAtHeight
+	// may include the transaction.  Zero means no limit.
+	ValidAfterHeight int `json:",omitempty"`
+	ExpiresAtHeight  int `json:",omitempty"`
+	// The policy of a multisig sender, and the signatures of its keys.
+	// PubKey and Sig are unused then.
+	Multisig *MultisigPolicy     `json:",omitempty"`
+	Sigs     []MultisigSignature `json:",omitempty"`
+	// Locks gold behind a hash time-lock, or releases locked gold.
+	Lock   *HashLock   `json:",omitempty"`
+	Unlock *HashUnlock `json:",omitempty"`
+	// The signature scheme and public key of the sender, unless it signs
+	// with RSA.  PubKey is unused then.
+	Scheme    string `json:",omitempty"`
+	SchemeKey []byte `json:",omitempty"`
 }
 
 func newTransaction(from string, nonce int, pubKey rsa.PublicKey, sig []byte, outputs map[string]int, fee int, data string) *Transaction {
 	transaction := new(Transaction)
+	transaction.Version = TX_VERSION
 	transaction.From = from
 	transaction.Nonce = nonce
 	transaction.PubKey = pubKey
@@ -42,24 +81,120 @@ func newTransaction(from string, nonce int, pubKey rsa.PublicKey, sig []byte, ou
 	return transaction
 }
 
+/**
+ * Returns the ID of a transaction, which is the hash of its canonical
+ * encoding.  The ID is also the message that gets signed.
+ *
+ * @returns {String} - The transaction ID, or "" for an unknown version.
+ */
 func getID(transaction Transaction) string {
-
-	return sha256hash(TX_CONST +
-		transaction.From +
-		strconv.Itoa(transaction.Nonce) +
-		getStringPubKey(&transaction.PubKey) +
-		createKeyValuePairs(transaction.Outputs) +
-		strconv.Itoa(transaction.Fee) +
-		transaction.Data)
+	payload, ok := transaction.canonicalEncoding()
+	if !ok {
+		return ""
+	}
+	return sha256hash(string(payload))
 }
 
-//From https://stackoverflow.com/a/48150584
-func createKeyValuePairs(m map[string]int) string {
-	b := new(bytes.Buffer)
-	for key, value := range m {
-		fmt.Fprintf(b, "%s=\"%s\"\n", key, value)
+/**
+ * Encodes every signed field of the transaction in a fixed order.
+ * Strings are prefixed with their length, integers are 8-byte big-endian,
+ * and outputs are sorted by address, so that every node produces the same
+ * bytes for the same transaction.
+ *
+ * @returns {[]byte} - The canonical encoding, and false for an unknown version.
+ */
+func (base Transaction) canonicalEncoding() ([]byte, bool) {
+	if base.Version != TX_VERSION {
+		return nil, false
+	}
+	enc := new(txEncoder)
+	enc.writeString(TX_DOMAIN_TAG)
+	enc.writeInt(int64(base.Version))
+	enc.writeString(base.From)
+	enc.writeInt(int64(base.Nonce))
+	if base.PubKey.N != nil {
+		enc.writeBytes(base.PubKey.N.Bytes())
+	} else {
+		enc.writeBytes(nil)
 	}
-	return b.String()
+	enc.writeInt(int64(base.PubKey.E))
+
+	addresses := make([]string, 0, len(base.Outputs))
+	for address := range base.Outputs {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	enc.writeInt(int64(len(addresses)))
+	for _, address := range addresses {
+		enc.writeString(address)
+		enc.writeInt(int64(base.Outputs[address]))
+	}
+
+	enc.writeInt(int64(base.Fee))
+	enc.writeString(base.Data)
+
+	// Optional fields are only written when they are set, each behind a tag,
+	// so transactions that do not use them keep the same ID.
+	if base.IO != nil {
+		enc.writeString("io")
+		enc.writeInt(int64(len(base.IO.Inputs)))
+		for _, input := range base.IO.Inputs {
+			enc.writeString(input.TxID)
+			enc.writeInt(int64(input.Index))
+		}
+		enc.writeInt(int64(len(base.IO.Outputs)))
+		for _, output := range base.IO.Outputs {
+			enc.writeString(output.Address)
+			enc.writeInt(int64(output.Amount))
+		}
+	}
+	if base.ValidAfterHeight != 0 || base.ExpiresAtHeight != 0 {
+		enc.writeString("height")
+		enc.writeInt(int64(base.ValidAfterHeight))
+		enc.writeInt(int64(base.ExpiresAtHeight))
+	}
+	if base.Multisig != nil {
+		enc.writeString("multisig")
+		base.Multisig.encode(enc)
+	}
+	if base.Lock != nil {
+		enc.writeString("lock")
+		enc.writeString(base.Lock.Recipient)
+		enc.writeInt(int64(base.Lock.Amount))
+		enc.writeString(base.Lock.Hash)
+		enc.writeInt(int64(base.Lock.TimeoutHeight))
+	}
+	if base.Unlock != nil {
+		enc.writeString("unlock")
+		enc.writeString(base.Unlock.LockID)
+		enc.writeString(base.Unlock.Preimage)
+	}
+	if base.Scheme != "" {
+		enc.writeString("scheme")
+		enc.writeString(base.Scheme)
+		enc.writeBytes(base.SchemeKey)
+	}
+	return enc.buf.Bytes(), true
+}
+
+// txEncoder builds the canonical encoding of a transaction.
+type txEncoder struct {
+	buf bytes.Buffer
+}
+
+func (base *txEncoder) writeInt(n int64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(n))
+	base.buf.Write(b[:])
+}
+
+func (base *txEncoder) writeBytes(b []byte) {
+	base.writeInt(int64(len(b)))
+	base.buf.Write(b)
+}
+
+func (base *txEncoder) writeString(s string) {
+	base.writeBytes([]byte(s))
 }
 
 //Passes transaction by pointer so we can modify inside it.
@@ -72,22 +207,52 @@ func createKeyValuePairs(m map[string]int) string {
 func signTransaction(privKey *rsa.PrivateKey, transaction *Transaction) {
 	id := getID(*transaction)
 	res := sign(privKey, id)
+	transaction.Id = id
 	transaction.Sig = res
 }
 
 /**
  * Determines whether the signature of the transaction is valid
- * and if the from address matches the public key.
+ * and if the from address matches the public key.  Transactions from
+ * a multisig address need enough valid signatures instead, and
+ * transactions naming a signature scheme are verified with that scheme.
+ * Verified signatures are remembered in a cache.
  *
  * @returns {Boolean} - Validity of the signature and from address.
  */
 func validSignatureTransaction(transaction Transaction) bool {
-	bool1 := len(transaction.Sig) != 0
-	bool2 := addressMatchesKey(transaction.From, &transaction.PubKey)
-	response := verifySignature(&transaction.PubKey, getID(transaction), transaction.Sig)
+	key, ok := sigCacheKey(transaction)
+	if !ok {
+		return false
+	}
+	if verifiedSignatures.contains(key) {
+		return true
+	}
+	valid := checkSignatureTransaction(transaction)
+	if valid {
+		verifiedSignatures.add(key)
+	}
+	return valid
+}
+
+/**
+ * Verifies the signatures of the transaction without using the cache.
+ *
+ * @returns {Boolean} - Validity of the signature and from address.
+ */
+func checkSignatureTransaction(transaction Transaction) bool {
+	if transaction.Multisig != nil {
+		return validMultisigTransaction(transaction)
+	}
+	if transaction.Scheme != "" {
+		return validSchemeSignature(transaction)
+	}
+	id := getID(transaction)
+	bool1 := len(transaction.Sig) != 0 && id != "" && id == transaction.Id
+	bool2 := transaction.PubKey.N != nil && addressMatchesKey(transaction.From, &transaction.PubKey)
 	bool3 := false
-	if response == nil {
-		bool3 = true
+	if bool1 && bool2 {
+		bool3 = verifySignature(&transaction.PubKey, id, transaction.Sig) == nil
 	}
 	return bool1 && bool2 && bool3
 }
@@ -96,29 +261,87 @@ func validSignatureTransaction(transaction Transaction) bool {
  * Verifies that there is currently sufficient gold for the transaction.
  *
  * @param {Block} block - Block used to check current balances
+ * @param {Number} released - Gold released to the sender by the transaction itself.
  *
  * @returns {boolean} - True if there are sufficient funds for the transaction,
  *    according to the balances from the specified block.
  */
-func (base Transaction) sufficientFunds(block Block) bool {
-	blockBalanceMap := block.Balances
-	blockValue := blockBalanceMap[base.From]
-	return base.totalOutputs() <= blockValue
+func (base Transaction) sufficientFunds(block Block, released int) bool {
+	return base.totalOutputs() <= block.balanceOf(base.From)+released
+}
+
+/**
+ * Determines whether a block at the given height may include the transaction.
+ *
+ * @param {Number} height - The chain length of the block.
+ *
+ * @returns {Boolean} - True if the height is within the lock-time and expiry heights.
+ */
+func (base Transaction) validAt(height int) bool {
+	return height > base.ValidAfterHeight && !base.expiredAt(height)
+}
+
+/**
+ * Determines whether the transaction has expired, so that neither a block at
+ * the given height nor any block after it may include the transaction.
+ *
+ * @param {Number} height - The chain length of the block.
+ *
+ * @returns {Boolean} - True if the transaction has expired.
+ */
+func (base Transaction) expiredAt(height int) bool {
+	return base.ExpiresAtHeight != 0 && height >= base.ExpiresAtHeight
 }
 
 /**
- * Calculates the total value of all outputs, including the transaction fee.
+ * Returns the gold paid to each address: the IO outputs of a UTXO-mode
+ * transaction, or otherwise the outputs map sorted by address.  Both the
+ * sender's debit and the recipients' credit are taken from this list.
+ *
+ * @returns {Array} - The payments of this transaction.
+ */
+func (base Transaction) payments() []TxOutput {
+	if base.IO != nil {
+		return base.IO.Outputs
+	}
+	addresses := make([]string, 0, len(base.Outputs))
+	for address := range base.Outputs {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	payments := make([]TxOutput, 0, len(addresses))
+	for _, address := range addresses {
+		payments = append(payments, TxOutput{address, base.Outputs[address]})
+	}
+	return payments
+}
+
+/**
+ * Calculates the total value of all outputs, including the transaction fee
+ * and any gold locked by a hash time-lock.
  *
  * @returns {Number} - Total amount of gold given out with this transaction.
  */
 func (base Transaction) totalOutputs() int {
-	var total = 0
-	for _, value := range base.Outputs {
-		total += value
+	var total = base.Fee
+	if base.Lock != nil {
+		total = addCapped(total, base.Lock.Amount)
+	}
+	for _, payment := range base.payments() {
+		total = addCapped(total, payment.Amount)
 	}
 	return total
 }
 
+// Adds two amounts of gold, stopping at the largest int instead of wrapping
+// around, so that huge outputs can never add up to a small total.
+func addCapped(a int, b int) int {
+	if b > 0 && a > math.MaxInt-b {
+		return math.MaxInt
+	}
+	return a + b
+}
+
 //from https://stackoverflow.com/questions/37532255/one-liner-to-transform-int-into-string
 func arrayToString(a []int, delim string) string {
 	return strings.Trim(strings.Replace(fmt.Sprint(a), " ", delim, -1), "[]")
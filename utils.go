@@ -17,6 +17,9 @@ import (
 type keypair struct {
 	pubKey  rsa.PublicKey
 	privKey *rsa.PrivateKey
+	// The key of a signature scheme other than RSA, in which case
+	// pubKey and privKey are unused.
+	signer Signer
 }
 
 /*
@@ -86,12 +89,21 @@ func verifySignature(pubKey *rsa.PublicKey, message string, sig []byte) error {
 }
 
 func calcAddress(pubKey *rsa.PublicKey) string {
+	enc := new(txEncoder)
+	enc.writeBytes(pubKey.N.Bytes())
+	enc.writeInt(int64(pubKey.E))
+	return encodeAddress(ADDRESS_VERSION, keyHash(SIG_SCHEME_RSA, enc.buf.Bytes()))
+}
+
+// The address format used before versioned addresses.  Transactions from
+// such addresses can still be verified, but clients no longer use them.
+func calcLegacyAddress(pubKey *rsa.PublicKey) string {
 	var stringPubKey = pubKey.N.String() + "" + strconv.Itoa(pubKey.E)
 	return base64.StdEncoding.EncodeToString([]byte(stringPubKey))
 }
 
 func addressMatchesKey(addr string, pubKey *rsa.PublicKey) bool {
-	return addr == calcAddress(pubKey)
+	return addr == calcAddress(pubKey) || addr == calcLegacyAddress(pubKey)
 }
 
 func getStringPubKey(pubKey *rsa.PublicKey) string {
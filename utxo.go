@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+/**
+ * Returns the ID used for the outputs that pay the coinbase reward of a block.
+ *
+ * @param {Block} block - The block whose miner is rewarded.
+ */
+func coinbaseTxID(block Block) string {
+	return sha256hash("COINBASE" + block.getID())
+}
+
+/**
+ * Returns the ID used for the output that holds a starting balance.
+ *
+ * @param {String} addr - The address that was given the starting balance.
+ */
+func genesisTxID(addr string) string {
+	return sha256hash("GENESIS" + addr)
+}
+
+/**
+ * Gives a starting balance to an address in the genesis block.  The balance
+ * is also recorded as an unspent output, so it can be spent in UTXO mode.
+ *
+ * @param {String} addr - The address receiving the balance.
+ * @param {Number} balance - The starting balance.
+ */
+func (base *Block) setGenesisBalance(addr string, balance int) {
+	base.ledger.setBalance(addr, base.balanceOf(addr)+balance)
+	base.ledger.addUTXO(OutPoint{genesisTxID(addr), 0}, TxOutput{addr, balance})
+	base.TotalSupply += balance
+}
+
+/**
+ * Pays the coinbase reward and fees of the previous block to its miner,
+ * both as balance and as an unspent output.
+ *
+ * @param {Block} prevBlock - The block whose miner is rewarded.
+ */
+func (base *Block) payReward(prevBlock Block) {
+	reward := prevBlock.totalRewards()
+	base.ledger.setBalance(prevBlock.RewardAddr, base.balanceOf(prevBlock.RewardAddr)+reward)
+	base.ledger.addUTXO(OutPoint{coinbaseTxID(prevBlock), 0}, TxOutput{prevBlock.RewardAddr, reward})
+}
+
+/**
+ * Accepts a UTXO-mode transaction if every input is an unspent output of
+ * the sender and the inputs pay exactly for the outputs plus the fee.
+ * Spending an output twice, within one transaction or across transactions,
+ * is rejected.
+ *
+ * @param {Transaction} tx - The transaction to add to the block.
+ *
+ * @returns {Boolean} - True if the transaction was added successfully.
+ */
+func (base Block) addUTXOTransaction(tx Transaction) bool {
+	if tx.IO == nil || len(tx.IO.Inputs) == 0 {
+		fmt.Printf("Transaction %v has no inputs.\n", tx.Id)
+		return false
+	}
+
+	totalIn := 0
+	seen := make(map[OutPoint]bool)
+	for _, input := range tx.IO.Inputs {
+		out, ok := base.ledger.utxo(input)
+		if !ok || seen[input] {
+			fmt.Printf("Double spend of output %v:%v in transaction %v.\n", input.TxID, input.Index, tx.Id)
+			return false
+		}
+		if out.Address != tx.From {
+			fmt.Printf("Transaction %v spends an output it does not own.\n", tx.Id)
+			return false
+		}
+		seen[input] = true
+		totalIn += out.Amount
+	}
+
+	if tx.Fee < 0 {
+		fmt.Printf("Negative fee in transaction %v.\n", tx.Id)
+		return false
+	}
+	totalOut := tx.Fee
+	for _, output := range tx.IO.Outputs {
+		if output.Amount <= 0 {
+			fmt.Printf("Invalid output amount in transaction %v.\n", tx.Id)
+			return false
+		}
+		totalOut += output.Amount
+	}
+	if totalIn != totalOut {
+		fmt.Printf("Inputs of transaction %v do not match its outputs and fee.\n", tx.Id)
+		return false
+	}
+
+	// Adding the transaction to the block
+	base.Transactions[tx.Id] = tx
+
+	for _, input := range tx.IO.Inputs {
+		base.ledger.spendUTXO(input)
+	}
+	base.ledger.setBalance(tx.From, base.balanceOf(tx.From)-totalIn)
+	for i, output := range tx.IO.Outputs {
+		base.ledger.addUTXO(OutPoint{tx.Id, i}, output)
+		base.ledger.setBalance(output.Address, base.balanceOf(output.Address)+output.Amount)
+	}
+	return true
+}
+
+/**
+ * Determines whether a pending transaction can no longer be added after
+ * this block, either because it was included or because it conflicts
+ * with an included transaction.
+ *
+ * @param {Transaction} tx - A transaction that has not been confirmed yet.
+ *
+ * @returns {Boolean} - True if the transaction is settled by this block.
+ */
+func (base Block) settles(tx Transaction) bool {
+	if tx.IO != nil {
+		for _, input := range tx.IO.Inputs {
+			if _, ok := base.ledger.utxo(input); !ok {
+				return true
+			}
+		}
+		return false
+	}
+	// Once the chain has used up a nonce, the transaction
+	// with that nonce can no longer be accepted.
+	return tx.Nonce < base.nextNonce(tx.From)
+}
+
+/**
+ * Returns the outputs of walletOutputs that belong to the client's main
+ * address.
+ *
+ * @returns {Object} - Map of the spendable outputs.
+ */
+func (base Client) spendableOutputs() map[OutPoint]TxOutput {
+	outputs := base.walletOutputs()
+	for op, out := range outputs {
+		if out.Address != base.address {
+			delete(outputs, op)
+		}
+	}
+	return outputs
+}
+
+/**
+ * Returns the confirmed unspent outputs of every wallet address of the
+ * client that are not already spent by one of its pending transactions.
+ * Outputs that pending sweeps pay to the client are included as well,
+ * since miners accept transactions that spend them.
+ *
+ * @returns {Object} - Map of the unspent outputs.
+ */
+func (base Client) walletOutputs() map[OutPoint]TxOutput {
+	reserved := make(map[OutPoint]bool)
+	for _, tx := range base.pendingOutGoingTransactionsMap {
+		if tx.IO != nil {
+			for _, input := range tx.IO.Inputs {
+				reserved[input] = true
+			}
+		}
+	}
+
+	outputs := make(map[OutPoint]TxOutput)
+	if base.lastConfirmedBlock.ledger == nil {
+		return outputs
+	}
+	owned := make(map[string]bool)
+	for _, addr := range base.walletAddresses() {
+		owned[addr] = true
+	}
+	for op, out := range base.lastConfirmedBlock.ledger.allUTXOs() {
+		if owned[out.Address] && !reserved[op] {
+			outputs[op] = out
+		}
+	}
+	for _, tx := range base.pendingOutGoingTransactionsMap {
+		if tx.IO == nil || tx.From == base.address {
+			continue
+		}
+		for i, out := range tx.IO.Outputs {
+			op := OutPoint{tx.Id, i}
+			if owned[out.Address] && !reserved[op] {
+				outputs[op] = out
+			}
+		}
+	}
+	return outputs
+}
+
+/**
+ * Picks spendable outputs that cover the payments plus the fee, and pays
+ * any change back to the client.  Outputs are picked in a fixed order,
+ * largest first.
+ *
+ * @param {Object} payments - Map of addresses to amounts to pay.
+ * @param {Number} fee - The transaction fee.
+ *
+ * @returns {TransactionIO} - The inputs and outputs of the transaction.
+ */
+func (base Client) selectOutputs(payments map[string]int, fee int) *TransactionIO {
+	io := new(TransactionIO)
+	needed := fee
+	addresses := make([]string, 0, len(payments))
+	for address := range payments {
+		addresses = append(addresses, address)
+	}
+	sort.Strings(addresses)
+	for _, address := range addresses {
+		io.Outputs = append(io.Outputs, TxOutput{address, payments[address]})
+		needed += payments[address]
+	}
+
+	spendable := base.spendableOutputs()
+	ops := make([]OutPoint, 0, len(spendable))
+	for op := range spendable {
+		ops = append(ops, op)
+	}
+	sort.Slice(ops, func(i, j int) bool {
+		if spendable[ops[i]].Amount != spendable[ops[j]].Amount {
+			return spendable[ops[i]].Amount > spendable[ops[j]].Amount
+		}
+		if ops[i].TxID != ops[j].TxID {
+			return ops[i].TxID < ops[j].TxID
+		}
+		return ops[i].Index < ops[j].Index
+	})
+
+	total := 0
+	for _, op := range ops {
+		if total >= needed {
+			break
+		}
+		io.Inputs = append(io.Inputs, op)
+		total += spendable[op].Amount
+	}
+	if total > needed {
+		io.Outputs = append(io.Outputs, TxOutput{base.address, total - needed})
+	}
+	return io
+}
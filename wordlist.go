@@ -0,0 +1,38 @@
+package main
+
+// The words of a mnemonic seed phrase.  Each word encodes one byte, so
+// the list has exactly 256 words, sorted so that a word's index is its byte.
+var MNEMONIC_WORDS = [256]string{
+	"able", "acid", "acorn", "actor", "adapt", "agent", "alarm", "album",
+	"alert", "alley", "amber", "angle", "ankle", "apple", "april", "arena",
+	"armor", "arrow", "aspen", "atlas", "attic", "audio", "autumn", "award",
+	"badge", "baker", "bamboo", "banner", "barrel", "basin", "beach", "beacon",
+	"beard", "berry", "bison", "blade", "blaze", "blossom", "board", "bonus",
+	"border", "bottle", "brave", "bread", "breeze", "brick", "bridge", "bright",
+	"bronze", "brush", "bubble", "bucket", "cabin", "cactus", "camel", "candle",
+	"canvas", "canyon", "carbon", "cargo", "carpet", "castle", "cedar", "cellar",
+	"chalk", "charm", "cherry", "chess", "circle", "civic", "claim", "clay",
+	"cliff", "clock", "cloud", "clover", "coast", "cobalt", "comet", "copper",
+	"coral", "cotton", "cradle", "crane", "crater", "crown", "crystal", "cube",
+	"dagger", "daisy", "dance", "dawn", "delta", "desert", "dial", "diamond",
+	"dolphin", "dove", "dragon", "dream", "drift", "drum", "eagle", "earth",
+	"echo", "eclipse", "elbow", "ember", "engine", "epic", "falcon", "feather",
+	"fence", "fern", "ferry", "fiber", "field", "flame", "flint", "flute",
+	"forest", "fossil", "fountain", "fox", "frost", "galaxy", "garden", "garlic",
+	"gate", "gem", "giant", "ginger", "glacier", "globe", "gold", "grain",
+	"granite", "grape", "gravel", "harbor", "harvest", "hawk", "hazel", "helmet",
+	"heron", "hollow", "honey", "horizon", "iron", "island", "ivory", "jacket",
+	"jade", "jaguar", "jelly", "jewel", "jungle", "kettle", "kite", "knight",
+	"ladder", "lagoon", "lantern", "laser", "lava", "lemon", "lily", "lion",
+	"lizard", "lotus", "lunar", "magnet", "maple", "marble", "meadow", "melon",
+	"meteor", "mint", "mirror", "moon", "mosaic", "moss", "mountain", "nectar",
+	"needle", "nest", "noble", "north", "oak", "oasis", "ocean", "olive",
+	"onyx", "orbit", "orchid", "otter", "owl", "paddle", "palace", "panda",
+	"paper", "pearl", "pebble", "pepper", "piano", "pilot", "pine", "planet",
+	"plum", "pond", "prism", "pulse", "quartz", "quest", "quill", "rabbit",
+	"radar", "rain", "raven", "reef", "ribbon", "river", "robin", "rocket",
+	"ruby", "saddle", "saffron", "sail", "salmon", "sand", "scroll", "shadow",
+	"shell", "shield", "silver", "sketch", "sky", "slate", "smoke", "snow",
+	"solar", "spark", "spice", "spider", "spiral", "spring", "spruce", "star",
+	"steam", "stone", "storm", "summit", "sun", "swan", "thunder", "tiger",
+}